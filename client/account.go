@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Keystore entries cannot be deleted, so a deleted account's username stays
+// taken. Its identity is retired instead: a retirement statement signed by
+// the user's newest key is left in the datastore, and a marker published in
+// the keystore under username+"retired" says where to look for it.
+
+func retiredUUID(username string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("retired")...))[:16])
+}
+
+// Reports whether username deleted their account
+func (c *Client) retired(username string) bool {
+	if _, ok := c.ks.Get(username + "retired"); !ok {
+		return false
+	}
+
+	u, err := retiredUUID(username)
+	if err != nil {
+		return false
+	}
+
+	data, ok := c.ds.Get(u)
+	if !ok {
+		return false
+	}
+
+	var wrap Data
+	if json.Unmarshal(data, &wrap) != nil || !bytes.Equal(wrap.Encrypted, []byte(username)) {
+		return false
+	}
+
+	vKey, err := c.verifyKey(username, wrap.Signer)
+	return err == nil && userlib.DSVerify(vKey, wrap.Encrypted, wrap.Authenticator) == nil
+}
+
+// DeleteAccount removes every file of the user, revoking the shares of the
+// files they own, and deletes the user's records. The username cannot be used
+// again, and invitations to it fail with ErrUserDeleted. Shares the user
+// passed on of files they received belong to the owner's tree and are left to
+// the owner.
+func (userdata *User) DeleteAccount(password string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("DeleteAccount", userdata.Username)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+	c := userdata.client
+	err = userdata.checkPassword(password)
+	if err != nil {
+		return err
+	}
+
+	names, err := userdata.loadNamespace()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = userdata.removeFile(name)
+		if errors.Is(err, ErrIntegrity) {
+			// A broken file is dropped rather than keeping the account alive
+			u, err := userdata.getFileMetaUUID(name)
+			if err != nil {
+				return err
+			}
+			err = c.ds.Delete(u)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var records []uuid.UUID
+	for i := 0; ; i += 1 {
+		slot, err := inboxSlot(userdata.Username, i)
+		if err != nil {
+			return err
+		}
+		if _, ok := c.ds.Get(slot); !ok {
+			break
+		}
+		records = append(records, slot)
+	}
+
+	config, err := c.loadRecoveryConfig(userdata.Username)
+	if err != nil && !errors.Is(err, ErrNoRecovery) && !errors.Is(err, ErrIntegrity) {
+		return err
+	}
+	for _, purpose := range append([]string{"", " key"}, prefixed("/", config.Trustees)...) {
+		u, err := recoveryUUID(userdata.Username, purpose)
+		if err != nil {
+			return err
+		}
+		records = append(records, u)
+	}
+
+	namespace, err := namespaceUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	contacts, err := contactsUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	records = append(records, namespace, contacts, userdata.PersonalUUID)
+
+	for _, u := range records {
+		err = c.ds.Delete(u)
+		if err != nil {
+			return wrapErr(ErrStorage, err)
+		}
+	}
+
+	// The records that unlock the account go after everything else, so a
+	// deletion that fails early can be retried. The retirement is published
+	// first, as nobody can log in to publish it once they are gone, and until
+	// it is the username would still take invitations.
+	err = userdata.retire()
+	if err != nil {
+		return err
+	}
+
+	rec, err := c.loadKDF(userdata.Username)
+	if err != nil {
+		return err
+	}
+	for _, record := range []func(string) (uuid.UUID, error){rec.keyRecordUUID, kdfRecordUUID, revisionUUID, userRecordUUID} {
+		u, err := record(userdata.Username)
+		if err != nil {
+			return err
+		}
+
+		err = c.ds.Delete(u)
+		if err != nil {
+			return wrapErr(ErrStorage, err)
+		}
+	}
+	return nil
+}
+
+// Publishes the retirement of the user's identity
+func (userdata *User) retire() error {
+	c := userdata.client
+	wrap, err := userdata.sign([]byte(userdata.Username))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(wrap)
+	if err != nil {
+		return err
+	}
+
+	u, err := retiredUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+
+	err = c.ds.Set(u, data)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+
+	// Someone may have published the marker first; the signed statement is
+	// what counts
+	vKey, err := c.verifyKey(userdata.Username, userdata.KeyVersion)
+	if err != nil {
+		return err
+	}
+	_ = c.ks.Set(userdata.Username+"retired", vKey)
+	return nil
+}
+
+func prefixed(prefix string, names []string) (out []string) {
+	for _, name := range names {
+		out = append(out, prefix+name)
+	}
+	return out
+}
@@ -0,0 +1,369 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Head of a file's chain, stored at Start and always sealed under the
+// current epoch. Blocks live at Hash(Base), Hash(Hash(Base)), ... StoreFile
+// writes the new content under a fresh Base and only then switches the head
+// over, so the file keeps its old content until the new content is in place.
+type Head struct {
+	Base    []byte `json:",omitempty"` // id the first block follows; Start if empty
+	End     []byte // id of the next block to be written
+	Count   int    // number of blocks in the chain
+	Marks   []int  // Marks[e] is the index of the first block written in epoch e or later
+	Version int    `json:",omitempty"` // raised whenever the head is written
+	Size    *int   `json:",omitempty"` // bytes of content; nil in heads written before sizes were kept
+}
+
+// Oldest epoch block i may be sealed under. Anything older could have been
+// forged by a user revoked since the block was written.
+func (head Head) floor(i int) (e int) {
+	for e+1 < len(head.Marks) && head.Marks[e+1] <= i {
+		e += 1
+	}
+	return e
+}
+
+// Accounts for a block of size bytes appended during epoch
+func (head *Head) push(epoch int, size int) {
+	for len(head.Marks) <= epoch {
+		head.Marks = append(head.Marks, head.Count)
+	}
+	head.End = userlib.Hash(head.End)
+	head.Count += 1
+	if head.Size != nil {
+		size += *head.Size
+		head.Size = &size
+	}
+}
+
+// Id of the first block of head's chain
+func (head Head) first(file File) []byte {
+	if head.Base == nil {
+		return userlib.Hash(file.Start)
+	}
+	return userlib.Hash(head.Base)
+}
+
+func (file File) epoch() int {
+	return len(file.Keys) - 1
+}
+
+func idToUUID(id []byte) (uuid.UUID, error) {
+	return uuid.FromBytes(id[:16])
+}
+
+// The head is stored at Start and every other id holds a block
+func (file File) kindOf(id []byte) string {
+	if bytes.Equal(id, file.Start) {
+		return kindHead
+	}
+	return kindBlock
+}
+
+// Loads the head of file, along with the entry it was read from, which
+// storeHead replaces
+func (c *Client) loadHead(file File) (head Head, raw []byte, err error) {
+	data, _, raw, err := c.loadEntry(file, file.Start, file.epoch())
+	if err != nil {
+		return head, nil, err
+	}
+
+	head, err = decodeHead(c.ds, file, data)
+	if err != nil {
+		return head, nil, err
+	}
+	return head, raw, nil
+}
+
+// Decodes the head of file. Heads written before they were JSON hold the
+// bare id of the next block, and their blocks are counted by walking the
+// chain in ds up to it; the head is stored in the current form by the next
+// write.
+func decodeHead(ds Datastore, file File, data []byte) (head Head, err error) {
+	err = json.Unmarshal(data, &head)
+	if err == nil {
+		return head, nil
+	} else if len(data) != len(userlib.Hash(nil)) {
+		return head, wrapErr(ErrIntegrity, err)
+	}
+
+	head = Head{End: data, Marks: []int{0}}
+	for id := head.first(file); !bytes.Equal(id, head.End); id = userlib.Hash(id) {
+		u, err := idToUUID(id)
+		if err != nil {
+			return head, err
+		}
+		if _, ok := ds.Get(u); !ok {
+			return head, fmt.Errorf("%w: Legacy head does not follow its chain", ErrIntegrity)
+		}
+		head.Count += 1
+	}
+	return head, nil
+}
+
+// Stores head under a new version in place of raw, the entry it was loaded
+// from, failing with ErrConcurrentModification if another session wrote the
+// head since. head is only changed once it is stored.
+func (c *Client) storeHead(file File, head *Head, raw []byte) error {
+	next := *head
+	next.Version += 1
+	bytes, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+
+	u, err := idToUUID(file.Start)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.swapEpoch(u, kindHead, bytes, file.Keys[file.epoch()], file.epoch(), raw)
+	if err != nil {
+		return err
+	}
+	*head = next
+	return nil
+}
+
+// Rewrites the head of file under the file's current epoch unless it is
+// sealed under it already. A revocation stopped part way may have left the
+// head under any earlier epoch, and appenders that have not seen a new epoch
+// yet may still write the head under the previous one, in which case it is
+// read again.
+func (c *Client) rekeyHead(file File) (head Head, err error) {
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		data, epoch, raw, err := c.loadEntry(file, file.Start, 0)
+		if err != nil {
+			return head, err
+		}
+
+		head, err = decodeHead(c.ds, file, data)
+		if err != nil || epoch == file.epoch() {
+			return head, err
+		}
+
+		err = c.storeHead(file, &head, raw)
+		if !errors.Is(err, ErrConcurrentModification) {
+			return head, err
+		}
+	}
+	return head, ErrConcurrentModification
+}
+
+// Seals content under the current epoch
+func (c *Client) storeBlock(file File, id []byte, content []byte) error {
+	u, err := idToUUID(id)
+	if err != nil {
+		return err
+	}
+	return c.encryptStoreEpoch(u, file.kindOf(id), content, file.Keys[file.epoch()], file.epoch())
+}
+
+// Writes content as a new block at id, returning the entry written. Fails
+// with ErrConcurrentModification if another session has written a block
+// there first.
+func (c *Client) claimBlock(file File, id []byte, content []byte) (written []byte, err error) {
+	u, err := idToUUID(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.swapEpoch(u, kindBlock, content, file.Keys[file.epoch()], file.epoch(), nil)
+}
+
+// Moves the head, loaded as head from raw, past the block of size bytes
+// claimed at its end, which is done once the head has moved past the block,
+// even if another session moved it. Fails to be done only if the chain was
+// replaced, after which the block is no longer needed. Returns the head as
+// last loaded.
+func (c *Client) commitBlock(file File, head Head, raw []byte, size int) (current Head, done bool, err error) {
+	slot := head.Count
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		next := head
+		next.push(file.epoch(), size)
+		err = c.storeHead(file, &next, raw)
+		if err == nil {
+			return next, true, nil
+		} else if !errors.Is(err, ErrConcurrentModification) {
+			return head, false, err
+		}
+
+		current, raw, err = c.loadHead(file)
+		if err != nil {
+			return head, false, err
+		} else if current.Count > slot {
+			// Another append adopted the block
+			return current, true, nil
+		} else if current.Count < slot || !bytes.Equal(current.Base, head.Base) {
+			return head, false, nil
+		}
+		head = current
+	}
+	return head, false, ErrConcurrentModification
+}
+
+// Moves the head, loaded as head from raw, past a block another append has
+// claimed at its end but not committed, as that append may have stopped
+// before it could. Blocks sealed under an earlier epoch are left alone, since
+// a revoked user could have written them.
+func (c *Client) adoptBlock(file File, head Head, raw []byte) error {
+	content, epoch, err := c.loadBlock(file, head.End, file.epoch())
+	if err != nil {
+		return nil
+	}
+
+	head.push(epoch, len(content))
+	err = c.storeHead(file, &head, raw)
+	if errors.Is(err, ErrConcurrentModification) {
+		return nil
+	}
+	return err
+}
+
+// The least a call writing content as a block and then the head as next
+// writes
+func writeCost(next Head, content []byte) (cost Usage, err error) {
+	data, err := json.Marshal(next)
+	if err != nil {
+		return cost, err
+	}
+	return Usage{BytesWritten: sealedSize(len(content)) + sealedSize(len(data)), RoundTrips: 2}, nil
+}
+
+// Writes content as the only block of a new chain and switches the head,
+// loaded from raw (nil for a new file), over to it under a version above
+// version. Nothing is written if the budget does not cover both writes. If
+// another session wrote the head first, the new block is dropped again and
+// the call fails with ErrConcurrentModification. The old chain is left to
+// dropChain.
+func (c *Client) replaceChain(file File, raw []byte, content []byte, version int) (head Head, err error) {
+	base := userlib.RandomBytes(64)
+	size := len(content)
+	next := Head{base, userlib.Hash(userlib.Hash(base)), 1, make([]int, file.epoch()+1), version, &size}
+	cost, err := writeCost(next, content)
+	if err != nil {
+		return head, err
+	}
+	err = c.afford(cost)
+	if err != nil {
+		return head, err
+	}
+
+	id := next.first(file)
+	written, err := c.claimBlock(file, id, content)
+	if err != nil {
+		return head, err
+	}
+
+	err = c.storeHead(file, &next, raw)
+	if err != nil {
+		c.releaseBlock(id, written)
+		return head, err
+	}
+	return next, nil
+}
+
+// Deletes the blocks of head's chain, along with any block claimed at its end
+// that was never committed
+func (c *Client) dropChain(file File, head Head) error {
+	id := head.first(file)
+	for i := 0; i <= head.Count; i += 1 {
+		u, err := idToUUID(id)
+		if err != nil {
+			return err
+		}
+		err = c.ds.Delete(u)
+		if err != nil {
+			return wrapErr(ErrStorage, err)
+		}
+		id = userlib.Hash(id)
+	}
+	return nil
+}
+
+// Deletes the block claimed as written, unless another session has since
+// replaced it
+func (c *Client) releaseBlock(id []byte, written []byte) error {
+	u, err := idToUUID(id)
+	if err != nil {
+		return err
+	}
+
+	err = c.swap(u, written, nil)
+	if errors.Is(err, ErrConcurrentModification) {
+		return nil
+	}
+	return err
+}
+
+// Opens the block at id, which must be sealed under floor or a later epoch
+func (c *Client) loadBlock(file File, id []byte, floor int) (content []byte, epoch int, err error) {
+	content, epoch, _, err = c.loadEntry(file, id, floor)
+	return content, epoch, err
+}
+
+// Like loadBlock, also returning the entry as stored
+func (c *Client) loadEntry(file File, id []byte, floor int) (content []byte, epoch int, raw []byte, err error) {
+	u, err := idToUUID(id)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	wrap, raw, err := c.getWrap(u)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if wrap.Epoch < floor || wrap.Epoch > file.epoch() {
+		return nil, 0, nil, fmt.Errorf("%w: Block sealed under unexpected epoch", ErrIntegrity)
+	}
+
+	content, raw, err = c.openEntry(u, file.kindOf(id), file.Keys[wrap.Epoch], wrap, raw)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return content, wrap.Epoch, raw, nil
+}
+
+// Re-seals the stale blocks under the current epoch and raises every floor to
+// it, after which keys of earlier epochs are no longer accepted for the chain.
+// raw is the entry head was loaded from. If another session writes the head
+// first, the floors are left for a later migration.
+func (c *Client) migrate(file File, head *Head, raw []byte, stale [][]byte) error {
+	if head.Count == 0 || head.floor(0) == file.epoch() {
+		return nil
+	}
+
+	for _, id := range stale {
+		content, _, err := c.loadBlock(file, id, 0)
+		if err != nil {
+			return err
+		}
+
+		err = c.storeBlock(file, id, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	next := *head
+	next.Marks = make([]int, file.epoch()+1)
+	err := c.storeHead(file, &next, raw)
+	if errors.Is(err, ErrConcurrentModification) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	c.log.Printf("Re-sealed %d blocks under epoch %d", len(stale), file.epoch())
+	*head = next
+	return nil
+}
@@ -57,7 +57,6 @@ func someUsefulThings() {
 		panic(err)
 	}
 
-	// userlib.DebugMsg("Struct: %v", course)
 	userlib.DebugMsg("JSON Data: %v", courseBytes)
 
 	// Generate a random private/public keypair.
@@ -76,7 +75,6 @@ func someUsefulThings() {
 	if err != nil {
 		panic(err)
 	}
-	// userlib.DebugMsg("Original Key: %v", originalKey)
 	userlib.DebugMsg("Derived Key: %v", derivedKey)
 
 	// A couple of tips on converting between string and []byte:
@@ -100,6 +98,14 @@ type User struct {
 	DecryptionKey	userlib.PrivateKeyType
 	SignatureKey	userlib.DSSignKey
 	PersonalUUID 	uuid.UUID
+	Revision		int `json:",omitempty"` // raised whenever the record is rewritten
+	KeyVersion		int `json:",omitempty"` // version of DecryptionKey and SignatureKey
+	RetiredKeys		map[int]userlib.PKEDecKey `json:",omitempty"` // decryption keys of earlier versions
+	Layout			int `json:",omitempty"` // records the account has been given, see currentLayout
+	client			*Client // the client the user was created or logged in with
+	keyfile			[]byte // the keyfile the user logged in with, if their account has one
+	heads			map[string]int // newest version of each file's head the session has seen, by headKey
+	salt			[]byte // salt of the KDF record the session logged in under, see LoginCurrent
 
 
 	// You can add other attributes here if you want! But note that in order for attributes to
@@ -110,85 +116,130 @@ type User struct {
 	// begins with a lowercase letter).
 }
 
-func (f FileMeta) newStructFile(start []byte, key []byte) (file File, err error) {
-	file.Start, file.Key = start, key
-	err = storeInDS(f.UUID, file, f.Key)
+func (c *Client) newStructFile(f FileMeta, start []byte, keys [][]byte) (file File, err error) {
+	file.Start, file.Keys = start, keys
+	err = c.storeInDS(f.UUID, kindFile, file, f.Key)
 	return file, err
 }
 
 type Data struct {
 	Encrypted		[]byte
 	Authenticator	[]byte
+	Epoch			int `json:",omitempty"`
+	Signer			int `json:",omitempty"` // key version that made a signature
+	Recipient		int `json:",omitempty"` // key version a public key ciphertext is for
+	Version			int `json:",omitempty"` // envelope format of a symmetric envelope, 0 before it had one
+	Alg				string `json:",omitempty"` // algorithms that sealed a symmetric envelope
+	KeyID			string `json:",omitempty"` // names the key that sealed a symmetric envelope
 }
 
+// Kinds of record sealed under a symmetric key. A record's MAC covers its
+// UUID and kind as well as its ciphertext, so records sealed under the same
+// key cannot be swapped or moved to another UUID.
+const (
+	kindUser        = "user"
+	kindSeed        = "seed"
+	kindKeyRecord   = "key record"
+	kindRevision    = "revision"
+	kindNamespace   = "namespace"
+	kindContacts    = "contacts"
+	kindRecoveryKey = "recovery key"
+	kindFileMeta    = "file meta"
+	kindFile        = "file"
+	kindHead        = "head"
+	kindBlock       = "block"
+	kindFreshness   = "freshness"
+)
+
 // Returns true if user has been created
-func userExists(username string) (exists bool) {
+func (c *Client) userExists(username string) (exists bool) {
 	strings.Compare("", "")
-	_, e := userlib.KeystoreGet(username + "e")
-	_, v := userlib.KeystoreGet(username + "v")
+	_, e := c.ks.Get(username + "e")
+	_, v := c.ks.Get(username + "v")
 	return e && v
 }
 
-func compare(a, b []byte) bool {
-	if len(a) == len(b) {
-		for i := 0; i < len(a); i+=1 {
-			if a[i] != b[i] {
-				return false
-			}
-		}
-		return true
-	} else {
-		return false
-	} 
+func (c *Client) InitUser(username string, password string) (userdataptr *User, err error) {
+	c = c.session()
+	defer c.trace("InitUser", username, username)(&err)
+	return c.initUser(username, password, nil)
 }
 
-func InitUser(username string, password string) (userdataptr *User, err error) {
+// InitUserWithKeyfile creates a user who logs in with both their password
+// and the returned keyfile, which should be kept apart from the password.
+func (c *Client) InitUserWithKeyfile(username string, password string) (userdataptr *User, keyfile []byte, err error) {
+	c = c.session()
+	defer c.trace("InitUserWithKeyfile", username, username)(&err)
+	keyfile = userlib.RandomBytes(32)
+	userdataptr, err = c.initUser(username, password, keyfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return userdataptr, keyfile, nil
+}
+
+func (c *Client) initUser(username string, password string, keyfile []byte) (userdataptr *User, err error) {
 	if len(username) == 0 {
-		return nil, errors.New("Username can't be empty")
+		return nil, ErrInvalidUsername
+	}
+	if c.userExists(username) {
+		return nil, ErrNameTaken
 	}
 
 	var userdata User
 	userdata.Username = username
+	userdata.client = c
 
 	var signatureKey, verificationKey, e = userlib.DSKeyGen()
 	if e != nil {
-		return nil, e
+		return nil, wrapErr(ErrCrypto, e)
 	}
-	err = userlib.KeystoreSet(userdata.Username + "v", verificationKey)
+	err = c.ks.Set(userdata.Username + "v", verificationKey)
 	if err != nil {
-		return nil, err
+		return nil, wrapErr(ErrNameTaken, err)
 	}
 
 	var encryptionKey, decryptionKey, e2 = userlib.PKEKeyGen()
 	if e2 != nil {
-		return nil, e2
+		return nil, wrapErr(ErrCrypto, e2)
 	}
-	err = userlib.KeystoreSet(userdata.Username + "e", encryptionKey)
+	err = c.ks.Set(userdata.Username + "e", encryptionKey)
 	if err != nil {
-		return nil, err
+		return nil, wrapErr(ErrNameTaken, err)
 	}
 
-	userB, passB :=  []byte(username), []byte(password)
-	var orginalKey = userlib.Argon2Key(passB, userB, 64)
+	userB := []byte(username)
 
 	userdata.PersonalUUID = uuid.New()
 	userdata.SignatureKey = signatureKey
-	userdata.PersonalKey = orginalKey[0:32]
+	userdata.PersonalKey = userlib.RandomBytes(32)
 	userdata.DecryptionKey = decryptionKey
 
+	userdata.keyfile = keyfile
+	rec, err := c.storeKeyRecord(username, userdata.PersonalKey, password, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	userdata.salt = rec.Salt
+
 	userUUID, e3 := uuid.FromBytes(userlib.Hash(userlib.Hash(userB))[:16])
 		
 	if e3 != nil {
-		fmt.Println(e3)
 		return nil, e3
 	}	
 
-	err = encryptStoreInDS(userdata.PersonalUUID, orginalKey, userdata.PersonalKey)
+	err = c.encryptStoreInDS(userdata.PersonalUUID, kindSeed, userlib.RandomBytes(64), userdata.PersonalKey)
 	if err != nil {
 		return nil, err
 	}
 
-	err = storeInDS(userUUID, userdata, userdata.PersonalKey) 
+	err = userdata.createRecords(0)
+	if err != nil {
+		return nil, err
+	}
+
+	userdata.Layout = currentLayout
+	err = c.storeInDS(userUUID, kindUser, userdata, userdata.PersonalKey) 
 	if err != nil {
 		return nil, err
 	}
@@ -200,65 +251,123 @@ func getKeyPair(key []byte) (sKey, mKey []byte) {
 	return key[:16], key[16:32]
 }
 
-func decryptGetData(u uuid.UUID, key []byte) (data []byte, err error) {
-	dKey, mKey := getKeyPair(key)
-
-	// userlib.DebugMsg("DatastoreGetFailure")
-	// userlib.DebugMsg("uuid in dgd: %s", u.String())
-
-	bytes, ok := userlib.DatastoreGet(u)
-	if !ok {
-		return nil, errors.New("Data unavailable")
-	}
-
-	// // userlib.DebugMsg("GOOD TRIPLE ZERO ONE")
-
-	var wrap Data
-	err = json.Unmarshal(bytes, &wrap)
+func (c *Client) decryptGetData(u uuid.UUID, kind string, key []byte) (data []byte, err error) {
+	wrap, raw, err := c.getWrap(u)
 	if err != nil {
 		return nil, err
 	}
+	data, _, err = c.openEntry(u, kind, key, wrap, raw)
+	return data, err
+}
 
-	// userlib.DebugMsg("GOOD TRIPLE ZERO TWO")
-
-	m, err := userlib.HMACEval(mKey, wrap.Encrypted)
+// Opens the entry raw, read from u as wrap. The entry is returned as it is
+// now stored, which differs from raw if it had to be upgraded.
+func (c *Client) openEntry(u uuid.UUID, kind string, key []byte, wrap Data, raw []byte) (data []byte, current []byte, err error) {
+	data, err = wrap.open(u, kind, key, c.legacy)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// userlib.DebugMsg("GOOD TRIPLE ZERO THREE")
+	current, err = c.upgrade(u, kind, wrap, raw, data, key)
+	return data, current, err
+}
 
-	if !userlib.HMACEqual(m, wrap.Authenticator) {
-		return nil, errors.New("MACs do not match")
+// Fetches the entry at u, returning it both decoded and as stored
+func (c *Client) getWrap(u uuid.UUID) (wrap Data, raw []byte, err error) {
+	raw, ok := c.ds.Get(u)
+	if !ok {
+		return wrap, nil, fmt.Errorf("%w: Data unavailable", ErrIntegrity)
 	}
 
-	// userlib.DebugMsg("GOOD TRIPLE ZERO FOUR")
+	err = json.Unmarshal(raw, &wrap)
+	if err != nil {
+		return wrap, nil, wrapErr(ErrIntegrity, err)
+	}
+	return wrap, raw, nil
+}
+
+func (c *Client) GetUser(username string, password string) (userdataptr *User, err error) {
+	c = c.session()
+	defer c.trace("GetUser", username, username)(&err)
+	return c.getUser(username, password, nil)
+}
 
-	data = userlib.SymDec(dKey, wrap.Encrypted)
-	return data, nil
+// GetUserWithKeyfile logs in a user who enrolled a keyfile. The keyfile is
+// ignored for users who have none.
+func (c *Client) GetUserWithKeyfile(username string, password string, keyfile []byte) (userdataptr *User, err error) {
+	c = c.session()
+	defer c.trace("GetUserWithKeyfile", username, username)(&err)
+	return c.getUser(username, password, keyfile)
 }
 
-func GetUser(username string, password string) (userdataptr *User, err error) {
-	if !userExists(username) {
-		return nil, errors.New("No user with username " + username)
+func (c *Client) getUser(username string, password string, keyfile []byte) (userdataptr *User, err error) {
+	if !c.userExists(username) {
+		return nil, ErrUserNotFound
+	}
+	if c.retired(username) {
+		return nil, ErrUserDeleted
 	}
 	u, err := uuid.FromBytes(userlib.Hash(userlib.Hash([]byte(username)))[:16])
 	if err != nil {
 		return nil, err
 	}
 
-	seed := userlib.Argon2Key([]byte(password), []byte(username), 64)
+	// Until the user record tells the layout of the account, entries without
+	// a header may be the account's own
+	c.legacy = true
+	master, rec, err := c.masterKey(username, password, keyfile)
+	if err != nil {
+		return nil, err
+	}
 
-	data, err := decryptGetData(u, seed[:32])
+	wrap, raw, err := c.getWrap(u)
 	if err != nil {
 		return nil, err
 	}
 
+	// A wrong password and a tampered record look alike from here
+	data, err := wrap.open(u, kindUser, master, c.legacy)
+	if errors.Is(err, ErrIntegrity) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
 	var user User
 	err = json.Unmarshal(data, &user)
+	if err != nil {
+		return nil, wrapErr(ErrIntegrity, err)
+	} else if wrap.Version == 0 && user.Layout >= layoutEnvelope {
+		return nil, fmt.Errorf("%w: User record without a header", ErrIntegrity)
+	}
+	c.legacy = user.Layout < layoutEnvelope
+
+	_, err = c.upgrade(u, kindUser, wrap, raw, data, master)
 	if err != nil {
 		return nil, err
 	}
+	user.client = c
+	if rec.Keyfile {
+		user.keyfile = keyfile
+	}
+
+	// Give older accounts a key record so their password can be changed, and
+	// bring the KDF costs up to the client's
+	if !rec.stored || rec.weaker(c.kdf) {
+		rec, err = c.storeKeyRecord(username, master, password, user.keyfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	user.salt = rec.Salt
+
+	if user.Layout < currentLayout {
+		err = user.upgradeLayout()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.legacy = false
 	userdataptr = &user
 	return userdataptr, nil
 
@@ -266,7 +375,16 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 
 type File struct {
 	Start	[]byte
-	Key 	[]byte
+	Keys 	[][]byte // Keys[e] seals the blocks written during epoch e
+	Revoked	bool `json:",omitempty"` // left in place of a revoked recipient's node
+	Key		[]byte `json:",omitempty"` // the only key of files stored before epochs
+}
+
+// Files stored before epochs have a single Key, which becomes epoch 0
+func (file *File) adoptLegacyKey() {
+	if len(file.Keys) == 0 && file.Key != nil {
+		file.Keys, file.Key = [][]byte{file.Key}, nil
+	}
 }
 
 /*func (userdata *User) StoreFile(filename string, content []byte) (err error) {
@@ -282,84 +400,114 @@ type File struct {
 	return
 }*/
 
-func loadData(id []byte, key []byte) (data []byte, err error) {
-	u, err := uuid.FromBytes(id[:16])
+func (userdata *User) StoreFile(filename string, content []byte) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("StoreFile", filename)(&err)
+	err = userdata.refresh()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return decryptGetData(u, key)
-}
-
-func (userdata *User) StoreFile(filename string, content []byte) error {
 	storageKey, err := userdata.getFileMetaUUID(filename)
-	// userlib.DebugMsg("StorageKey in StoreFile: %s", storageKey)
-
 	if err != nil {
 		return err
 	}
 
-	_, present := userlib.DatastoreGet(storageKey)
-	var file File
+	// The new content is in place before anything of the old is removed, so
+	// a call stopped part way leaves the file as it was
+	c := userdata.client
+	_, present := c.ds.Get(storageKey)
+	if !present {
+		return userdata.createFile(storageKey, filename, content)
+	}
 
-	if (!present) {
-		var f FileMeta
-		f.Key, err = userdata.KeyGen()
-		f.Successors = make(map[string]FileMeta)
-		f.IsSuccessor = false
-		f.UUID = uuid.New()
-		if err != nil {
-			return err
-		}
+	file, err := userdata.getFile(filename)
+	if err != nil {
+		return err
+	}
 
-		err = storeInDS(storageKey, f, userdata.PersonalKey)
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		old, raw, err := c.loadHead(file)
 		if err != nil {
 			return err
 		}
 
-		key, err := userdata.KeyGen()
+		// The new head must be newer than any head seen so far, even if the
+		// one being replaced was rolled back
+		version, err := userdata.seenVersion(file)
 		if err != nil {
 			return err
 		}
-		file, err = f.newStructFile(userlib.RandomBytes(64), key)
-		if err != nil {
-			return err
+		if old.Version > version {
+			version = old.Version
 		}
 
-		// userlib.DebugMsg("bp 1")
-
-		err = storeData(file.Start, userlib.Hash(file.Start), key)
-		if err != nil {
+		// Every block is rewritten, so none may be sealed under an older epoch
+		head, err := c.replaceChain(file, raw, content, version)
+		if errors.Is(err, ErrConcurrentModification) {
+			continue
+		} else if err != nil {
 			return err
 		}
 
-		// userlib.DebugMsg("bp 2")
-	
-	} else {
-		file, err = userdata.getFile(filename)
+		err = userdata.recordFresh(file, head)
 		if err != nil {
 			return err
 		}
+
+		// The old blocks are unreachable now, and are only deleted if the
+		// budget allows, as the call has already succeeded
+		if c.afford(Usage{RoundTrips: old.Count + 1}) != nil {
+			c.log.Printf("Left %d blocks of a replaced chain over budget", old.Count)
+			return nil
+		}
+		return c.dropChain(file, old)
 	}
-	
-	file.deleteFile()
+	return ErrConcurrentModification
+}
 
-	// userlib.DebugMsg("bp 3")
-	currId := userlib.Hash(file.Start)
-	err = storeData(currId, content, file.Key)
+// Stores content as a new file under filename, whose FileMeta is at u. The
+// file is complete before it is given a FileMeta and a place in the
+// namespace.
+func (userdata *User) createFile(u uuid.UUID, filename string, content []byte) (err error) {
+	c := userdata.client
+	var f FileMeta
+	f.Key, err = userdata.keyGen()
+	f.Successors = make(map[string]FileMeta)
+	f.IsSuccessor = false
+	f.UUID = uuid.New()
 	if err != nil {
 		return err
 	}
 
-	// userlib.DebugMsg("bp 4")
-
-
+	key, err := userdata.keyGen()
+	if err != nil {
+		return err
+	}
+	file, err := c.newStructFile(f, userlib.RandomBytes(64), [][]byte{key})
+	if err != nil {
+		return err
+	}
 
-	err = storeData(file.Start, userlib.Hash(currId), file.Key)
+	head, err := c.replaceChain(file, nil, content, 0)
+	if err != nil {
+		return err
+	}
 
-	// userlib.DebugMsg(storageKey.String())
-	// userlib.DebugMsg(userdata.getFileMetaUUID(userlib.Hash(storageKey)).String())
+	err = c.swapInDS(u, kindFileMeta, f, userdata.PersonalKey, nil)
+	if errors.Is(err, ErrConcurrentModification) {
+		// Another session created the file first
+		c.deleteFile(file)
+		c.ds.Delete(f.UUID)
+		return err
+	} else if err != nil {
+		return err
+	}
 
-	return err
+	err = userdata.addToNamespace(filename)
+	if err != nil {
+		return err
+	}
+	return userdata.recordFresh(file, head)
 }
 
 func (user User) getFileMetaUUID(filename string) (u uuid.UUID, err error) {
@@ -367,205 +515,316 @@ func (user User) getFileMetaUUID(filename string) (u uuid.UUID, err error) {
 }
 
 func (user User) loadFileMeta(filename string) (ret FileMeta, err error) {
-	u, err := user.getFileMetaUUID(filename)
+	ret, _, err = user.loadFileMetaEntry(filename)
+	return ret, err
+}
 
-	// userlib.DebugMsg("uuid in lfm: %s", u.String())
+// Like loadFileMeta, also returning the entry as stored, for swapInDS
+func (user User) loadFileMetaEntry(filename string) (ret FileMeta, raw []byte, err error) {
+	u, err := user.getFileMetaUUID(filename)
 
 	if err != nil {
-		return ret, err
+		return ret, nil, err
 	}
 
-	// userlib.DebugMsg("GOOD ZERO ZERO ONE")
-
-	bytes, err := decryptGetData(u, user.PersonalKey)
+	bytes, raw, err := user.client.readEntry(u, kindFileMeta, user.PersonalKey)
 	if err != nil {
-		return ret, err
+		return ret, nil, err
+	} else if bytes == nil {
+		return ret, nil, ErrFileNotFound
 	}
 
-	// // userlib.DebugMsg("GOOD ZERO ZERO TWO")
-
 	err = json.Unmarshal(bytes, &ret)
-	return ret, err
+	if err != nil {
+		return ret, nil, wrapErr(ErrIntegrity, err)
+	}
+	return ret, raw, nil
 }
 
 func (user User) getFile(filename string) (ret File, err error) {
-	// // userlib.DebugMsg("GOOD ZERO ZERO")
-
 	fileInfo, err := user.loadFileMeta(filename)
 	if err != nil {
 		return ret, err
 	}
 
-	// userlib.DebugMsg("GOOD ZERO ONE")
+	return user.client.loadFile(fileInfo)
+}
 
-	bytes, err := decryptGetData(fileInfo.UUID, fileInfo.Key)
+func (c *Client) loadFile(f FileMeta) (ret File, err error) {
+	bytes, err := c.decryptGetData(f.UUID, kindFile, f.Key)
 	if err != nil {
 		return ret, err
 	}
 
-	// userlib.DebugMsg("GOOD ZERO TWO")
-
 	err = json.Unmarshal(bytes, &ret)
-	return ret, err
-}
-
-func (userdata *User) AppendToFile(filename string, content []byte) error {
-	file, err := userdata.getFile(filename)
 	if err != nil {
-		return err
+		return ret, wrapErr(ErrIntegrity, err)
 	}
+	ret.adoptLegacyKey()
 
-	// userlib.DebugMsg("GOOD ONE")
-	// userlib.DebugMsg(string(file.Start))
+	if ret.Revoked {
+		return ret, ErrAccessRevoked
+	} else if len(ret.Keys) == 0 || len(ret.Start) < 16 {
+		return ret, fmt.Errorf("%w: Malformed file struct", ErrIntegrity)
+	}
+	return ret, nil
+}
 
-	id, err := loadData(file.Start, file.Key)
+func (userdata *User) AppendToFile(filename string, content []byte) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("AppendToFile", filename)(&err)
+	err = userdata.refresh()
 	if err != nil {
 		return err
 	}
-
-	// userlib.DebugMsg("GOOD TWO")
-
-	err = storeData(id, content, file.Key)
+	file, err := userdata.getFile(filename)
 	if err != nil {
 		return err
 	}
 
-	// userlib.DebugMsg("GOOD THREE")
+	// The block is claimed before the head is moved past it, so appends from
+	// other devices neither overwrite it nor get overwritten by it
+	c := userdata.client
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		head, raw, err := userdata.loadFreshHead(file)
+		if err != nil {
+			return err
+		}
 
-	err = storeData(file.Start, userlib.Hash(id), file.Key)
-	return err
-}
+		next := head
+		next.push(file.epoch(), len(content))
+		cost, err := writeCost(next, content)
+		if err != nil {
+			return err
+		}
+		err = c.afford(cost)
+		if err != nil {
+			return err
+		}
 
-func storeData(bytes []byte, data []byte, key []byte) error {
-	u, err := uuid.FromBytes(bytes[:16])
-	// userlib.DebugMsg("uuid in sc: %s", u)
-	if err != nil {
-		return err
+		written, err := c.claimBlock(file, head.End, content)
+		if errors.Is(err, ErrConcurrentModification) {
+			err = c.adoptBlock(file, head, raw)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		head, done, err := c.commitBlock(file, head, raw, len(content))
+		if err != nil {
+			return err
+		} else if done {
+			return userdata.recordFresh(file, head)
+		}
+
+		err = c.releaseBlock(head.End, written)
+		if err != nil {
+			return err
+		}
 	}
-	return encryptStoreInDS(u, data, key)
+	return ErrConcurrentModification
 }
 
+// LoadFile fails with ErrRollback if the file's head is older than one the
+// user has loaded or written before.
 func (userdata *User) LoadFile(filename string) (content []byte, err error) {
-	// userlib.DebugMsg("GOOD ZERO")
-
-	file, err := userdata.getFile(filename)
+	defer userdata.lock()()
+	defer userdata.trace("LoadFile", filename)(&err)
+	err = userdata.refresh()
 	if err != nil {
 		return nil, err
 	}
-
-	// userlib.DebugMsg("GOOD ONE")
-
-	old, err := loadData(file.Start, file.Key)
+	fileInfo, err := userdata.loadFileMeta(filename)
 	if err != nil {
 		return nil, err
 	}
+	content, _, err = userdata.loadContent(fileInfo)
+	return content, err
+}
 
-	// userlib.DebugMsg("GOOD TWO")
+// Loads the content of f, returning it along with the head it was read under
+func (userdata *User) loadContent(f FileMeta) (content []byte, head Head, err error) {
+	c := userdata.client
+	file, err := c.loadFile(f)
+	if err != nil {
+		return nil, head, err
+	}
 
-	for id := userlib.Hash(file.Start); !compare(id, old); id = userlib.Hash(id) {
-		new, err := loadData(id, file.Key)
+	head, raw, err := userdata.loadFreshHead(file)
+	if err != nil {
+		return nil, head, err
+	}
+
+	var stale [][]byte
+	id := head.first(file)
+	for i := 0; i < head.Count; i += 1 {
+		new, epoch, err := c.loadBlock(file, id, head.floor(i))
 		if err != nil {
-			return nil, err
+			return nil, head, err
+		}
+		if epoch < file.epoch() {
+			stale = append(stale, id)
 		}
 
 		content = append(content, new...)
+		id = userlib.Hash(id)
 	}
 
-	// userlib.DebugMsg("GOOD THREE")
-
-	return content, nil
+	err = c.migrate(file, &head, raw, stale)
+	if err != nil {
+		return nil, head, err
+	}
+	return content, head, userdata.recordFresh(file, head)
 }
 
-func (user *User) inviteStore(u uuid.UUID, invInfo InvitationMeta, rec string) error {
-	eKey, _ := userlib.KeystoreGet(rec + "e")
-	sKey := user.SignatureKey
+func (user *User) inviteStore(u uuid.UUID, invInfo InvitationMeta, rec string, filename string) error {
 	toEnc, err := json.Marshal(invInfo)
 	if err != nil {
 		return err
 	}
 
-	enc, err := userlib.PKEEnc(eKey, toEnc)
+	// Sealed rather than encrypted with PKEEnc directly, which would cap the
+	// size of InvitationMeta
+	bytes, err := user.seal(rec, toEnc)
 	if err != nil {
 		return err
 	}
-	
-	sign, err := userlib.DSSign(sKey, enc)
+
+	err = user.client.ds.Set(u, bytes)
 	if err != nil {
-		return err
+		return wrapErr(ErrStorage, err)
 	}
+	return user.inboxStore(u, rec, filename)
+}
 
-	wrap := Data{enc, sign}
-	bytes, err := json.Marshal(wrap)
+func (userdata *User) CreateInvitation(filename string, recipientUsername string) (invitationPtr uuid.UUID, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("CreateInvitation", filename)(&err)
+	err = userdata.refresh()
 	if err != nil {
-		return err
+		return invitationPtr, err
+	}
+	results, err := userdata.createInvitations(filename, []string{recipientUsername})
+	if err != nil {
+		return invitationPtr, err
 	}
+	return results[recipientUsername].Pointer, results[recipientUsername].Err
+}
 
-	userlib.DatastoreSet(u, bytes)
-	return nil
+// Outcome of inviting a single recipient in CreateInvitations
+type InvitationResult struct {
+	Pointer uuid.UUID
+	Err     error
 }
 
-func (userdata *User) CreateInvitation(filename string, recipientUsername string) (invitationPtr uuid.UUID, err error) {
-	if !userExists(recipientUsername) {
-		return invitationPtr, errors.New("No user with username " + recipientUsername)
+// CreateInvitations shares filename with every recipient at once. Errors that
+// concern a single recipient are reported in its result; err is only set when
+// the file itself could not be shared.
+func (userdata *User) CreateInvitations(filename string, recipients []string) (results map[string]InvitationResult, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("CreateInvitations", filename)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return nil, err
 	}
+	return userdata.createInvitations(filename, recipients)
+}
 
-	_, err = userdata.getFile(filename)
+func (userdata *User) createInvitations(filename string, recipients []string) (results map[string]InvitationResult, err error) {
+	fileInfo, raw, err := userdata.loadFileMetaEntry(filename)
 	if err != nil {
-		return invitationPtr, err
+		return nil, err
 	}
 
-	fileInfo, err := userdata.loadFileMeta(filename)
+	file, err := userdata.client.loadFile(fileInfo)
 	if err != nil {
-		return invitationPtr, err
+		return nil, err
 	}
 
-	if fileInfo.IsSuccessor == true {
-		invitationPtr = uuid.New()
-		invInfo := InvitationMeta{fileInfo.UUID, fileInfo.Key}
-		err = userdata.inviteStore(invitationPtr, invInfo, recipientUsername)
-		return invitationPtr, err
-	} else {
-		k, err := userdata.KeyGen()
-		if err != nil {
-			return invitationPtr, err
+	results = make(map[string]InvitationResult)
+	changed := false
+	for _, rec := range recipients {
+		if _, done := results[rec]; done {
+			continue
 		}
 
-		childInfo := FileMeta { UUID: uuid.New(), Key: k }
-
-		file, err := userdata.getFile(filename)
-		if err != nil {
-			return invitationPtr, err
+		if !userdata.client.userExists(rec) {
+			results[rec] = InvitationResult{Err: &OpError{"CreateInvitation", rec, ErrUserNotFound}}
+			continue
 		}
 
-		_, err = childInfo.newStructFile(file.Start, file.Key)
+		err = userdata.checkContact(rec)
 		if err != nil {
-			return invitationPtr, err
+			results[rec] = InvitationResult{Err: &OpError{"CreateInvitation", rec, err}}
+			continue
 		}
 
-		invitationPtr = uuid.New()
+		// Successors share their own node; owners hand each recipient a child node
+		invInfo := InvitationMeta{UUID: fileInfo.UUID, Key: fileInfo.Key, Sender: userdata.Username}
+		var child *FileMeta
+		if fileInfo.IsSuccessor == false {
+			childInfo, ok := fileInfo.Successors[rec]
+			if !ok {
+				childInfo, err = userdata.newChild(file)
+				if err != nil {
+					results[rec] = InvitationResult{Err: &OpError{"CreateInvitation", rec, err}}
+					continue
+				}
+				child = &childInfo
+			}
+			invInfo.UUID, invInfo.Key = childInfo.UUID, childInfo.Key
+		}
 
-		invInfo := InvitationMeta{childInfo.UUID, childInfo.Key}
-		err = userdata.inviteStore(invitationPtr, invInfo, recipientUsername)
+		// A new child only becomes a successor once its invitation is out, so
+		// a recipient who never got one is not left to revoke
+		ptr := uuid.New()
+		err = userdata.inviteStore(ptr, invInfo, rec, filename)
 		if err != nil {
-			return invitationPtr, err
+			err = &OpError{"CreateInvitation", rec, err}
+			userdata.client.ds.Delete(ptr)
+			if child != nil {
+				userdata.client.ds.Delete(child.UUID)
+			}
+		} else if child != nil {
+			fileInfo.Successors[rec] = *child
+			changed = true
 		}
+		results[rec] = InvitationResult{ptr, err}
+	}
 
-		u, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(userdata.Username)), userlib.Hash([]byte(filename))...))[:16])
+	if changed {
+		u, err := userdata.getFileMetaUUID(filename)
+		if err != nil {
+			return nil, err
+		}
 
-		parentInfo, err := userdata.loadFileMeta(filename)
+		err = userdata.client.swapInDS(u, kindFileMeta, fileInfo, userdata.PersonalKey, raw)
 		if err != nil {
-			return invitationPtr, err
+			return nil, err
 		}
+	}
+	return results, nil
+}
 
-		parentInfo.Successors[recipientUsername] = childInfo
-		err = storeInDS(u, parentInfo, userdata.PersonalKey)
-		return invitationPtr, err
+// Creates a child node pointing at file for a new direct recipient
+func (userdata *User) newChild(file File) (childInfo FileMeta, err error) {
+	childInfo.Key, err = userdata.keyGen()
+	if err != nil {
+		return childInfo, err
 	}
+
+	childInfo.UUID = uuid.New()
+	_, err = userdata.client.newStructFile(childInfo, file.Start, file.Keys)
+	return childInfo, err
 }
 
 type InvitationMeta struct {
 	UUID 	uuid.UUID
 	Key 	[]byte
+	Sender	string // checked against the signer, so others cannot pass the invitation off as theirs
 }
 
 type FileMeta struct {
@@ -575,35 +834,88 @@ type FileMeta struct {
 	Successors		map[string] FileMeta 
 }
 
-func storeInDS(u uuid.UUID, object interface{}, key []byte) error {
+func (c *Client) storeInDS(u uuid.UUID, kind string, object interface{}, key []byte) error {
 	bytes, err := json.Marshal(object)
 	if err != nil {
 		return err
 	}
-	return encryptStoreInDS(u, bytes, key)
+	return c.encryptStoreInDS(u, kind, bytes, key)
+}
+
+func (c *Client) encryptStoreInDS(u uuid.UUID, kind string, data []byte, key []byte) error {
+	return c.encryptStoreEpoch(u, kind, data, key, 0)
 }
 
-func encryptStoreInDS(u uuid.UUID, data []byte, key []byte) error {
-	eKey, mKey := getKeyPair(key)
-	enc := userlib.SymEnc(eKey, userlib.RandomBytes(16), data)
-	m, err := userlib.HMACEval(mKey, enc)
+// Like encryptStoreInDS, tagging the entry with the epoch of key
+func (c *Client) encryptStoreEpoch(u uuid.UUID, kind string, data []byte, key []byte, epoch int) error {
+	bytes, err := sealEntry(u, kind, data, key, epoch)
 	if err != nil {
 		return err
 	}
 
-	wrap := Data{enc, m}
-	bytes, err := json.Marshal(wrap)
+	err = c.ds.Set(u, bytes)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+	return nil
+}
+
+// Seals data as a datastore entry for a record of kind at u
+func sealEntry(u uuid.UUID, kind string, data []byte, key []byte, epoch int) ([]byte, error) {
+	wrap, err := sealEnvelope(u, kind, data, key, epoch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(wrap)
+}
+
+// Like storeInDS, in place of raw, the entry the record was read from (nil if
+// there was none). Fails with ErrConcurrentModification if another session
+// has rewritten the entry since.
+func (c *Client) swapInDS(u uuid.UUID, kind string, object interface{}, key []byte, raw []byte) error {
+	bytes, err := json.Marshal(object)
 	if err != nil {
 		return err
 	}
+	_, err = c.swapEpoch(u, kind, bytes, key, 0, raw)
+	return err
+}
 
-	userlib.DatastoreSet(u, bytes)
+// Like encryptStoreEpoch, in place of raw as for swapInDS, returning the
+// entry written
+func (c *Client) swapEpoch(u uuid.UUID, kind string, data []byte, key []byte, epoch int, raw []byte) (written []byte, err error) {
+	written, err = sealEntry(u, kind, data, key, epoch)
+	if err != nil {
+		return nil, err
+	}
+	return written, c.swap(u, raw, written)
+}
+
+// Replaces the entry raw at u with written, or deletes it if written is nil
+func (c *Client) swap(u uuid.UUID, raw []byte, written []byte) error {
+	swapped, err := compareAndSwap(c.ds, u, raw, written)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	} else if !swapped {
+		return ErrConcurrentModification
+	}
 	return nil
 }
 
-func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) error {
-	if !userExists(senderUsername) {
-		return errors.New("No user with username " + senderUsername)
+func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("AcceptInvitation", filename)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+	if !userdata.client.userExists(senderUsername) {
+		return ErrUserNotFound
+	}
+
+	err = userdata.checkContact(senderUsername)
+	if err != nil {
+		return err
 	}
 
 	u, err := userdata.getFileMetaUUID(filename)
@@ -611,41 +923,46 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 		return err
 	}
 
-	_, ok := userlib.DatastoreGet(u)
+	_, ok := userdata.client.ds.Get(u)
 	if ok {
-		return errors.New("Cannot accept invitation for existing file")
+		return ErrNameTaken
 	}
 
 	// Load info
 	var invInfo InvitationMeta
 
-	dKey := userdata.DecryptionKey
-	vKey, _ := userlib.KeystoreGet(senderUsername + "v")
-
-	bytes, ok := userlib.DatastoreGet(invitationPtr)
+	bytes, ok := userdata.client.ds.Get(invitationPtr)
 	if !ok {
-		return errors.New("Invitation Pointer doesn't point to invitation")
+		return fmt.Errorf("%w: Invitation Pointer doesn't point to invitation", ErrInvalidInvitation)
 	}
 
 	var wrap Data
 	err = json.Unmarshal(bytes, &wrap)
 	if err != nil {
-		return err
+		return wrapErr(ErrInvalidInvitation, err)
+	}
+
+	vKey, err := userdata.client.verifyKey(senderUsername, wrap.Signer)
+	if err != nil {
+		return wrapErr(ErrInvalidInvitation, err)
 	}
 
 	err = userlib.DSVerify(vKey, wrap.Encrypted, wrap.Authenticator)
 	if err != nil {
-		return err
+		return wrapErr(ErrInvalidInvitation, err)
 	}
 
-	data, err := userlib.PKEDec(dKey, wrap.Encrypted)
+	_, data, err := userdata.unseal(bytes)
 	if err != nil {
 		return err
 	}
 
 	err = json.Unmarshal(data, &invInfo)
 	if err != nil {
-		return err
+		return wrapErr(ErrInvalidInvitation, err)
+	}
+	if invInfo.Sender != senderUsername {
+		return fmt.Errorf("%w: Invitation was made by %s", ErrInvalidInvitation, invInfo.Sender)
 	}
 
 	fileInfo := FileMeta {
@@ -653,126 +970,422 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 		IsSuccessor: true,
 		Key: invInfo.Key }
 
-	err = storeInDS(u, fileInfo, userdata.PersonalKey)
+	// Check the share is still live before adding it to the namespace
+	_, _, err = userdata.loadContent(fileInfo)
+	if err != nil {
+		return err
+	}
+
+	err = userdata.client.swapInDS(u, kindFileMeta, fileInfo, userdata.PersonalKey, nil)
+	if errors.Is(err, ErrConcurrentModification) {
+		return ErrNameTaken
+	} else if err != nil {
+		return err
+	}
+
+	err = userdata.addToNamespace(filename)
+	if err != nil {
+		return err
+	}
+
+	err = userdata.client.ds.Delete(invitationPtr)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+	return nil
+
+}
+
+func (userdata *User) KeyGen() (key []byte, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("KeyGen", userdata.Username)(&err)
+	return userdata.keyGen()
+}
+
+// Like KeyGen, for calls that hold the account lock
+func (user User) keyGen() (key []byte, err error) {
+	err = user.client.modify(user.PersonalUUID, kindSeed, user.PersonalKey, func(seed []byte) ([]byte, error) {
+		if len(seed) != 64 {
+			return nil, fmt.Errorf("%w: Key seed unavailable", ErrIntegrity)
+		}
+
+		// Fresh randomness keeps sessions that read the same seed from
+		// handing out the same key
+		seed, err := userlib.HashKDF(seed[48:64], append([]byte("seed"), userlib.RandomBytes(16)...))
+		if err != nil {
+			return nil, wrapErr(ErrCrypto, err)
+		}
+		key = seed[:32]
+		return seed, nil
+	})
+	return key, err
+}
+
+// Deletes the file's head and blocks, returning the deleted head
+func (c *Client) deleteFile(file File) (head Head, err error) {
+	head, _, err = c.loadHead(file)
+	if err != nil {
+		return head, err
+	}
+
+	u, err := idToUUID(file.Start)
+	if err != nil {
+		return head, err
+	}
+	err = c.ds.Delete(u)
+	if err != nil {
+		return head, wrapErr(ErrStorage, err)
+	}
+	return head, c.dropChain(file, head)
+}
+
+func (userdata *User) RevokeAccess(filename string, recipientUsername string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("RevokeAccess", filename)(&err)
+	if !userdata.client.userExists(recipientUsername) {
+		return ErrUserNotFound
+	}
+
+	err = userdata.refresh()
 	if err != nil {
 		return err
 	}
 
-	_, err = userdata.LoadFile(filename)
+	notShared, err := userdata.revokeAccessMany(filename, []string{recipientUsername})
 	if err != nil {
 		return err
 	}
 
-	userlib.DatastoreDelete(invitationPtr)
+	if len(notShared) > 0 {
+		return ErrNotShared
+	}
 	return nil
+}
 
+// RevokeAccessMany revokes every recipient in a single key rotation. The
+// names the file was not directly shared with are returned in notShared, once
+// each however often they are listed.
+func (userdata *User) RevokeAccessMany(filename string, recipients []string) (notShared []string, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("RevokeAccessMany", filename)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return userdata.revokeAccessMany(filename, recipients)
 }
 
-func (user User) KeyGen() (key []byte, err error) {
-	// userlib.DebugMsg("Begin KG")
-	seed, err := decryptGetData(user.PersonalUUID, user.PersonalKey)
+func (userdata *User) revokeAccessMany(filename string, recipients []string) (notShared []string, err error) {
+	fileInfo, raw, err := userdata.loadFileMetaEntry(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	seed, err = userlib.HashKDF(seed[48:64], []byte("seed"))
+	var revoked []FileMeta
+	listed := make(map[string]bool)
+	for _, rec := range recipients {
+		if listed[rec] {
+			continue
+		}
+		listed[rec] = true
+
+		childInfo, ok := fileInfo.Successors[rec]
+		if !ok {
+			notShared = append(notShared, rec)
+			continue
+		}
+
+		revoked = append(revoked, childInfo)
+		delete(fileInfo.Successors, rec)
+	}
+
+	if len(revoked) == 0 {
+		return notShared, nil
+	}
+
+	file, err := userdata.client.loadFile(fileInfo)
 	if err != nil {
 		return nil, err
 	}
 
-	err = encryptStoreInDS(user.PersonalUUID, seed, user.PersonalKey)
-	// userlib.DebugMsg("End KG")
-	return seed[:32], err
-}
+	// The recipients stay in the file meta until the rotation is done, so a
+	// rotation stopped part way is started over by calling again. It may have
+	// left the head under an earlier epoch than the file struct, which is
+	// caught up first.
+	_, err = userdata.client.rekeyHead(file)
+	if err != nil {
+		return nil, err
+	}
 
-func (file File) deleteFile() error {
-	// userlib.DebugMsg("begin delete")
-	old, err := loadData(file.Start, file.Key)
+	_, _, err = userdata.loadFreshHead(file)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Start a new epoch: existing blocks stay readable under the old keys
+	// and are re-sealed on the next LoadFile, while anything written from
+	// now on is out of reach of the revoked subtrees.
+	key, err := userdata.keyGen()
+	if err != nil {
+		return nil, err
 	}
+	file.Keys = append(file.Keys, key)
+	userdata.client.log.Printf("%s: revoking %d recipients, starting epoch %d", filename, len(revoked), file.epoch())
 
-	for id := file.Start; !compare(id, old); id = userlib.Hash(id) {
-		u, err := uuid.FromBytes(id[:16])
+	// Tombstones tell the revoked subtrees apart from missing or corrupt data
+	for _, childInfo := range revoked {
+		err = userdata.client.storeInDS(childInfo.UUID, kindFile, File{Revoked: true}, childInfo.Key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		userlib.DatastoreDelete(u)
 	}
-	// userlib.DebugMsg("end delete")
 
-	return nil
-}
+	err = userdata.client.storeInDS(fileInfo.UUID, kindFile, file, fileInfo.Key)
+	if err != nil {
+		return nil, err
+	}
 
-func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
-	if !userExists(recipientUsername) {
-		return errors.New("No user with username " + recipientUsername)
+	for _, childInfo := range fileInfo.Successors {
+		err = userdata.client.storeInDS(childInfo.UUID, kindFile, file, childInfo.Key)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	file, err := userdata.getFile(filename)
+	head, err := userdata.client.rekeyHead(file)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = userdata.recordFresh(file, head)
+	if err != nil {
+		return nil, err
 	}
 
+	u, err := userdata.getFileMetaUUID(filename)
+	if err != nil {
+		return nil, err
+	}
+	return notShared, userdata.client.swapInDS(u, kindFileMeta, fileInfo, userdata.PersonalKey, raw)
+}
+
+// How a user holds a file, as reported by AccessStatus
+type Access int
+
+const (
+	AccessNone Access = iota
+	AccessOwner
+	AccessShared
+	AccessRevoked
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessOwner:
+		return "owner"
+	case AccessShared:
+		return "shared"
+	case AccessRevoked:
+		return "revoked"
+	}
+	return "none"
+}
+
+// AccessStatus reports how the user holds filename. A non-nil error means the
+// status could not be determined, e.g. because an entry failed authentication.
+func (userdata *User) AccessStatus(filename string) (access Access, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("AccessStatus", filename)(&err)
 	fileInfo, err := userdata.loadFileMeta(filename)
+	if errors.Is(err, ErrFileNotFound) {
+		return AccessNone, nil
+	} else if err != nil {
+		return AccessNone, err
+	}
+
+	file, err := userdata.client.loadFile(fileInfo)
+	if errors.Is(err, ErrAccessRevoked) {
+		return AccessRevoked, nil
+	} else if err != nil {
+		return AccessNone, err
+	}
+
+	_, _, err = userdata.client.loadHead(file)
 	if err != nil {
-		return err
+		return AccessNone, err
 	}
 
-	content, err := userdata.LoadFile(filename)
+	if fileInfo.IsSuccessor {
+		return AccessShared, nil
+	}
+	return AccessOwner, nil
+}
+
+// FileStat describes a file as of its head.
+type FileStat struct {
+	Size    int // bytes of content
+	Version int // raised by every write to the file, by any user
+}
+
+// StatFile returns the size and version of filename without loading its
+// content, so callers can tell cheaply whether it changed. The head is
+// checked for rollback as by LoadFile. Files not stored again since sizes
+// were added to heads are loaded to measure them.
+func (userdata *User) StatFile(filename string) (stat FileStat, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("StatFile", filename)(&err)
+	err = userdata.refresh()
 	if err != nil {
-		return err
+		return stat, err
+	}
+	fileInfo, err := userdata.loadFileMeta(filename)
+	if err != nil {
+		return stat, err
 	}
 
-	file.Start = userlib.RandomBytes(64)
-	file.Key, err = userdata.KeyGen()
+	file, err := userdata.client.loadFile(fileInfo)
 	if err != nil {
-		return err
+		return stat, err
+	}
+	head, _, err := userdata.loadFreshHead(file)
+	if err != nil {
+		return stat, err
+	}
+
+	if head.Size == nil {
+		var content []byte
+		content, head, err = userdata.loadContent(fileInfo)
+		if err != nil {
+			return stat, err
+		}
+		return FileStat{len(content), head.Version}, nil
 	}
+	return FileStat{*head.Size, head.Version}, nil
+}
 
-	err = storeInDS(fileInfo.UUID, file, fileInfo.Key)
+// RemoveFile takes filename out of the user's namespace. Removing a file the
+// user owns deletes its content and revokes everyone it was shared with, while
+// removing a shared file only drops the user's own access.
+func (userdata *User) RemoveFile(filename string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("RemoveFile", filename)(&err)
+	err = userdata.refresh()
 	if err != nil {
 		return err
 	}
+	return userdata.removeFile(filename)
+}
 
-	err = userdata.StoreFile(filename, content)
+func (userdata *User) removeFile(filename string) (err error) {
+	fileInfo, err := userdata.loadFileMeta(filename)
 	if err != nil {
 		return err
 	}
 
-	userlib.DebugMsg("%d", len(fileInfo.Successors))
-	flag := false
-	for username, childInfo := range fileInfo.Successors {
-		
-		bytes, err := decryptGetData(childInfo.UUID, childInfo.Key)
+	if !fileInfo.IsSuccessor {
+		file, err := userdata.client.loadFile(fileInfo)
 		if err != nil {
 			return err
 		}
 
-		var child File
-		err = json.Unmarshal(bytes, &child)
+		_, err = userdata.client.deleteFile(file)
 		if err != nil {
 			return err
 		}
-	
-		if username == recipientUsername {
-			child.deleteFile()
-			userlib.DatastoreDelete(childInfo.UUID)
-			flag = true
-			delete(fileInfo.Successors, recipientUsername)
-		} else {
-			child.Start = file.Start
-			child.Key = file.Key
-			err = storeInDS(childInfo.UUID, child, childInfo.Key)
+
+		err = userdata.forgetFresh(file)
+		if err != nil {
+			return err
+		}
+
+		for _, childInfo := range fileInfo.Successors {
+			err = userdata.client.storeInDS(childInfo.UUID, kindFile, File{Revoked: true}, childInfo.Key)
 			if err != nil {
 				return err
 			}
 		}
+
+		err = userdata.client.ds.Delete(fileInfo.UUID)
+		if err != nil {
+			return wrapErr(ErrStorage, err)
+		}
+	} else if file, err := userdata.client.loadFile(fileInfo); err == nil {
+		// Revoked users can no longer find the file's head, and leave its
+		// freshness record behind
+		err = userdata.forgetFresh(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	u, err := userdata.getFileMetaUUID(filename)
+	if err != nil {
+		return err
 	}
 
-	if flag == false {
-		return errors.New("File not shared with " + recipientUsername)
+	err = userdata.client.ds.Delete(u)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
 	}
+	return userdata.removeFromNamespace(filename)
+}
 
-	return err
+// RenameFile moves a file to a new name in the user's namespace. Sharing is
+// unaffected and recipients keep their own names for the file.
+func (userdata *User) RenameFile(filename string, newname string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("RenameFile", filename)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+	fileInfo, err := userdata.loadFileMeta(filename)
+	if err != nil {
+		return err
+	}
+
+	u, err := userdata.getFileMetaUUID(newname)
+	if err != nil {
+		return err
+	}
+
+	_, ok := userdata.client.ds.Get(u)
+	if ok {
+		return ErrNameTaken
+	}
+
+	err = userdata.client.swapInDS(u, kindFileMeta, fileInfo, userdata.PersonalKey, nil)
+	if errors.Is(err, ErrConcurrentModification) {
+		return ErrNameTaken
+	} else if err != nil {
+		return err
+	}
+
+	err = userdata.addToNamespace(newname)
+	if err != nil {
+		return err
+	}
+
+	u, err = userdata.getFileMetaUUID(filename)
+	if err != nil {
+		return err
+	}
+
+	err = userdata.client.ds.Delete(u)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+	return userdata.removeFromNamespace(filename)
+}
+
+// DeriveKey returns a 32-byte key for purpose that is the same in every
+// session of the user, for protecting data kept outside the datastore.
+func (userdata *User) DeriveKey(purpose string) (key []byte, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("DeriveKey", purpose)(&err)
+	key, err = userlib.HashKDF(userdata.PersonalKey[:16], []byte("derive/"+purpose))
+	if err != nil {
+		return nil, wrapErr(ErrCrypto, err)
+	}
+	return key[:32], nil
 }
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// The contact list pins, for every user the user has shared with or heard
+// from, the fingerprint of their keys at first contact. Later rotations are
+// followed as long as they are certified by the pinned version; any other
+// change fails with ErrKeyChanged until the user confirms the new keys. So
+// does a first contact while a version newer than the certified ones is
+// published: it may be squatted, or certified by a certificate that was
+// deleted to make others fall back to keys that leaked.
+
+type contact struct {
+	Version     int
+	Fingerprint []byte
+}
+
+func contactsUUID(username string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("contacts")...))[:16])
+}
+
+func (user User) loadContacts() (contacts map[string]contact, err error) {
+	u, err := contactsUUID(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := user.client.readEntry(u, kindContacts, user.PersonalKey)
+	if err != nil {
+		return nil, err
+	}
+	return decodeContacts(data)
+}
+
+// Decodes the contact list, which every account has been given since
+// layoutContacts
+func decodeContacts(data []byte) (contacts map[string]contact, err error) {
+	if data == nil {
+		return nil, fmt.Errorf("%w: Contact list unavailable", ErrIntegrity)
+	}
+
+	err = json.Unmarshal(data, &contacts)
+	if err != nil {
+		return nil, wrapErr(ErrIntegrity, err)
+	}
+	if contacts == nil {
+		contacts = make(map[string]contact)
+	}
+	return contacts, nil
+}
+
+// Pins username's keys at version, with fingerprint fp
+func (user User) pinContact(username string, version int, fp []byte) error {
+	u, err := contactsUUID(user.Username)
+	if err != nil {
+		return err
+	}
+
+	return user.client.modify(u, kindContacts, user.PersonalKey, func(data []byte) ([]byte, error) {
+		contacts, err := decodeContacts(data)
+		if err != nil {
+			return nil, err
+		}
+
+		contacts[username] = contact{version, fp}
+		return json.Marshal(contacts)
+	})
+}
+
+// Hash of the public keys username published as version
+func (c *Client) fingerprint(username string, version int) ([]byte, error) {
+	eKey, ok := c.ks.Get(keyName(username, "e", version))
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	vKey, ok := c.ks.Get(keyName(username, "v", version))
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	e, err := json.Marshal(eKey)
+	if err != nil {
+		return nil, err
+	}
+	v, err := json.Marshal(vKey)
+	if err != nil {
+		return nil, err
+	}
+	return userlib.Hash(append(e, v...))[:16], nil
+}
+
+// Returns username's newest certified key version and its fingerprint, along
+// with all their certified versions
+func (c *Client) newestKeys(username string) (version int, fp []byte, versions []int, err error) {
+	versions, _, err = c.keyVersions(username)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	version = versions[len(versions)-1]
+	fp, err = c.fingerprint(username, version)
+	return version, fp, versions, err
+}
+
+// Checks username's keys against the contact list, pinning them at first
+// contact and following rotations certified by the pinned version
+func (user *User) checkContact(username string) error {
+	if username == user.Username {
+		return nil
+	}
+
+	c := user.client
+	versions, published, err := c.keyVersions(username)
+	if err != nil {
+		return err
+	}
+
+	version := versions[len(versions)-1]
+	fp, err := c.fingerprint(username, version)
+	if err != nil {
+		return err
+	}
+
+	contacts, err := user.loadContacts()
+	if err != nil {
+		return err
+	}
+
+	pin, ok := contacts[username]
+	if ok && pin.Version == version && bytes.Equal(pin.Fingerprint, fp) {
+		return nil
+	} else if !ok && published > version {
+		return fmt.Errorf("%w: %s published key version %d without a certificate; confirm their fingerprint %s", ErrKeyChanged, username, published, formatFingerprint(fp))
+	}
+
+	if ok {
+		// keyVersions only returns versions certified by their predecessor,
+		// so a newer version reached from the pinned one is vouched for by it
+		pinned, err := c.fingerprint(username, pin.Version)
+		if err != nil || !hasVersion(versions, pin.Version) || !bytes.Equal(pinned, pin.Fingerprint) {
+			return fmt.Errorf("%w: Keys of %s do not match the pinned fingerprint %s", ErrKeyChanged, username, formatFingerprint(pin.Fingerprint))
+		}
+	}
+
+	return user.pinContact(username, version, fp)
+}
+
+func formatFingerprint(fp []byte) string {
+	s := hex.EncodeToString(fp)
+	var groups []string
+	for i := 0; i < len(s); i += 4 {
+		groups = append(groups, s[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// Fingerprint returns the fingerprint of username's current keys, to be
+// compared with what username sees for themselves before ConfirmContact.
+// Users see their own keys as of their user record rather than as published.
+func (userdata *User) Fingerprint(username string) (fingerprint string, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("Fingerprint", username)(&err)
+	if !userdata.client.userExists(username) {
+		return "", ErrUserNotFound
+	}
+
+	if username == userdata.Username {
+		err = userdata.refresh()
+		if err != nil {
+			return "", err
+		}
+		fp, err := userdata.client.fingerprint(username, userdata.KeyVersion)
+		if err != nil {
+			return "", err
+		}
+		return formatFingerprint(fp), nil
+	}
+
+	_, fp, _, err := userdata.client.newestKeys(username)
+	if err != nil {
+		return "", err
+	}
+	return formatFingerprint(fp), nil
+}
+
+// ConfirmContact pins username's current keys, replacing any earlier pin, if
+// their fingerprint is the one given. Spacing and case are ignored.
+func (userdata *User) ConfirmContact(username string, fingerprint string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("ConfirmContact", username)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+	if !userdata.client.userExists(username) {
+		return ErrUserNotFound
+	}
+
+	version, fp, _, err := userdata.client.newestKeys(username)
+	if err != nil {
+		return err
+	}
+
+	given := strings.ToLower(strings.Join(strings.Fields(fingerprint), ""))
+	if given != hex.EncodeToString(fp) {
+		return fmt.Errorf("%w: %s has fingerprint %s", ErrKeyChanged, username, formatFingerprint(fp))
+	}
+
+	return userdata.pinContact(username, version, fp)
+}
@@ -0,0 +1,246 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Symmetric envelopes carry a header naming their format version, the
+// algorithms that sealed them and an ID of the key, all covered by the MAC
+// along with the UUID and kind of the record. Entries written before the
+// header existed are only opened while logging in to an account from before
+// layoutEnvelope, which re-seals them; entries of version 1 are opened by
+// every session. Both are re-sealed in the current format when read.
+
+const envelopeVersion = 2
+
+// Seals data, authenticating ad along with the ciphertext, and opens the
+// result again
+type envelopeAlg struct {
+	seal func(key []byte, data []byte, ad []byte) (enc []byte, tag []byte, err error)
+	open func(key []byte, enc []byte, tag []byte, ad []byte) (data []byte, err error)
+}
+
+const algAESHMAC = "aes-ctr+hmac-sha512"
+
+var envelopeAlgs = map[string]envelopeAlg{
+	algAESHMAC: {sealAESHMAC, openAESHMAC},
+}
+
+// The algorithm new envelopes are sealed with
+const currentAlg = algAESHMAC
+
+func sealAESHMAC(key []byte, data []byte, ad []byte) (enc []byte, tag []byte, err error) {
+	eKey, mKey := getKeyPair(key)
+	enc = userlib.SymEnc(eKey, userlib.RandomBytes(16), data)
+	tag, err = userlib.HMACEval(mKey, append(append([]byte{}, ad...), enc...))
+	if err != nil {
+		return nil, nil, wrapErr(ErrCrypto, err)
+	}
+	return enc, tag, nil
+}
+
+func openAESHMAC(key []byte, enc []byte, tag []byte, ad []byte) (data []byte, err error) {
+	dKey, mKey := getKeyPair(key)
+	m, err := userlib.HMACEval(mKey, append(append([]byte{}, ad...), enc...))
+	if err != nil {
+		return nil, wrapErr(ErrCrypto, err)
+	}
+
+	if !userlib.HMACEqual(m, tag) {
+		return nil, fmt.Errorf("%w: MACs do not match", ErrIntegrity)
+	}
+	return userlib.SymDec(dKey, enc), nil
+}
+
+// Names key without revealing it, so an envelope sealed under the wrong key
+// can be told apart from a tampered one
+func keyID(key []byte) (string, error) {
+	_, mKey := getKeyPair(key)
+	id, err := userlib.HMACEval(mKey, []byte("key id"))
+	if err != nil {
+		return "", wrapErr(ErrCrypto, err)
+	}
+	return hex.EncodeToString(id[:8]), nil
+}
+
+// Starts the MAC input of current envelopes. No UUID a client reads from can
+// equal it, so the input cannot be taken for that of an older format.
+const envelopeDomain = "sealed envelope\x00"
+
+// The bytes MACed ahead of the ciphertext of a record of kind stored at u,
+// each field prefixed with its length
+func macInput(u uuid.UUID, kind string, header []byte) []byte {
+	input := []byte(envelopeDomain)
+	for _, field := range [][]byte{u[:], []byte(kind), header} {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(field)))
+		input = append(append(input, n[:]...), field...)
+	}
+	return input
+}
+
+// The MAC input of envelopes of version 1, or without a header if header is
+// nil, which were bound to u and kind by separating them with zero bytes
+func legacyMacInput(u uuid.UUID, kind string, header []byte) []byte {
+	input := append(u[:], []byte(kind)...)
+	input = append(input, 0)
+	if header == nil {
+		return input
+	}
+	input = append(input, header...)
+	return append(input, 0)
+}
+
+func (wrap Data) header() []byte {
+	return []byte(fmt.Sprintf("%d %s %s %d", wrap.Version, wrap.Alg, wrap.KeyID, wrap.Epoch))
+}
+
+// Seals data under key, tagged with epoch, as a record of kind stored at u
+func sealEnvelope(u uuid.UUID, kind string, data []byte, key []byte, epoch int) (wrap Data, err error) {
+	id, err := keyID(key)
+	if err != nil {
+		return wrap, err
+	}
+
+	wrap = Data{Epoch: epoch, Version: envelopeVersion, Alg: currentAlg, KeyID: id}
+	wrap.Encrypted, wrap.Authenticator, err = envelopeAlgs[currentAlg].seal(key, data, macInput(u, kind, wrap.header()))
+	return wrap, err
+}
+
+// An upper bound on the size of the entry sealing n bytes, so writes can be
+// checked against a budget before they are made. The ciphertext adds an IV
+// and at most a block of padding, and is base64 encoded along with the MAC
+// and the header.
+func sealedSize(n int) int {
+	return 4*(n+32+2)/3 + 256
+}
+
+// Authenticates and decrypts wrap, which must be a record of kind read from
+// u. Entries without a header are rejected unless legacy is set.
+func (wrap Data) open(u uuid.UUID, kind string, key []byte, legacy bool) (data []byte, err error) {
+	if wrap.Version == 0 && legacy {
+		return wrap.openLegacy(u, kind, key)
+	} else if wrap.Version == 0 {
+		return nil, fmt.Errorf("%w: Entry without a header", ErrIntegrity)
+	}
+
+	alg, ok := envelopeAlgs[wrap.Alg]
+	if wrap.Version > envelopeVersion || !ok {
+		return nil, fmt.Errorf("%w: Unsupported envelope version %d with %q", ErrIntegrity, wrap.Version, wrap.Alg)
+	}
+
+	id, err := keyID(key)
+	if err != nil {
+		return nil, err
+	}
+	if wrap.KeyID != id {
+		return nil, fmt.Errorf("%w: Sealed under another key", ErrIntegrity)
+	}
+
+	ad := macInput(u, kind, wrap.header())
+	if wrap.Version == 1 {
+		ad = legacyMacInput(u, kind, wrap.header())
+	}
+	return alg.open(key, wrap.Encrypted, wrap.Authenticator, ad)
+}
+
+// Opens an entry written before envelopes had a header. Its MAC covers the
+// UUID and kind of the record, or for the oldest entries the ciphertext
+// alone, so such entries can be swapped, and forged from current ones, which
+// is why they are only opened until the account is re-sealed.
+func (wrap Data) openLegacy(u uuid.UUID, kind string, key []byte) (data []byte, err error) {
+	data, err = openAESHMAC(key, wrap.Encrypted, wrap.Authenticator, legacyMacInput(u, kind, nil))
+	if errors.Is(err, ErrIntegrity) {
+		data, err = openAESHMAC(key, wrap.Encrypted, wrap.Authenticator, nil)
+	}
+	return data, err
+}
+
+// Re-seals an entry that was read in an older envelope format, returning the
+// entry as now stored. An entry another session rewrote in the meantime is
+// left to that session.
+func (c *Client) upgrade(u uuid.UUID, kind string, wrap Data, raw []byte, data []byte, key []byte) (current []byte, err error) {
+	if wrap.Version == envelopeVersion {
+		return raw, nil
+	}
+
+	current, err = sealEntry(u, kind, data, key, wrap.Epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	swapped, err := compareAndSwap(c.ds, u, raw, current)
+	if err != nil {
+		return nil, wrapErr(ErrStorage, err)
+	} else if !swapped {
+		return raw, nil
+	}
+	return current, nil
+}
+
+// Re-seals the entries of the account and of the files in its namespace, so
+// that none is left without a header once entries without one stop being
+// opened. Files that fail to load are left for their next use to report.
+// Files stored before the namespace existed cannot be found, and stop
+// opening unless they were read since.
+func (userdata *User) resealAccount() error {
+	c := userdata.client
+	_, _, err := c.readEntry(userdata.PersonalUUID, kindSeed, userdata.PersonalKey)
+	if err != nil {
+		return err
+	}
+
+	records := []struct {
+		uuid func(string) (uuid.UUID, error)
+		kind string
+	}{
+		{revisionUUID, kindRevision},
+		{namespaceUUID, kindNamespace},
+		{contactsUUID, kindContacts},
+	}
+	for _, r := range records {
+		u, err := r.uuid(userdata.Username)
+		if err != nil {
+			return err
+		}
+		_, _, err = c.readEntry(u, r.kind, userdata.PersonalKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	names, err := userdata.loadNamespace()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		fileInfo, err := userdata.loadFileMeta(name)
+		if err == nil {
+			_, _, err = userdata.loadContent(fileInfo)
+		}
+		if err != nil && !fileFailure(err) {
+			return err
+		}
+
+		// Nodes of recipients who have yet to accept are only read by them
+		for _, child := range fileInfo.Successors {
+			_, err = c.loadFile(child)
+			if err != nil && !fileFailure(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether err concerns a single file rather than the account
+func fileFailure(err error) bool {
+	return errors.Is(err, ErrIntegrity) || errors.Is(err, ErrAccessRevoked) || errors.Is(err, ErrFileNotFound)
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUserNotFound is returned when no user has the given username.
+	ErrUserNotFound = errors.New("User not found")
+
+	// ErrInvalidUsername is returned by InitUser for an empty username.
+	ErrInvalidUsername = errors.New("Invalid username")
+
+	// ErrInvalidCredentials is returned by GetUser when the password does not
+	// open the user record. A tampered record is reported the same way.
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+
+	// ErrKeyfileRequired is returned by GetUser for users who enrolled a
+	// keyfile; they log in with GetUserWithKeyfile.
+	ErrKeyfileRequired = errors.New("Keyfile required")
+
+	// ErrInvalidArgument is returned when a call is given arguments it
+	// cannot work with, e.g. a recovery threshold above the number of
+	// trustees.
+	ErrInvalidArgument = errors.New("Invalid argument")
+
+	// ErrFileNotFound is returned when the user has no file by the given name.
+	ErrFileNotFound = errors.New("File not found")
+
+	// ErrNameTaken is returned when creating a user or accepting a file under
+	// a name that is already in use.
+	ErrNameTaken = errors.New("Name already taken")
+
+	// ErrNotShared is returned when revoking access from a user the file was
+	// not directly shared with.
+	ErrNotShared = errors.New("File not shared with user")
+
+	// ErrInvalidInvitation is returned when an invitation or inbox entry is
+	// missing, not addressed to the user, or not signed by its sender.
+	ErrInvalidInvitation = errors.New("Invalid invitation")
+
+	// ErrIntegrity is returned when a datastore entry the client relies on is
+	// missing, malformed or fails authentication.
+	ErrIntegrity = errors.New("Integrity check failed")
+
+	// ErrAccessRevoked is returned to recipients whose access to a file was
+	// revoked by its owner.
+	ErrAccessRevoked = errors.New("Access revoked")
+
+	// ErrCrypto is returned when a cryptographic primitive fails for reasons
+	// other than authentication, e.g. key generation or encryption.
+	ErrCrypto = errors.New("Cryptographic operation failed")
+
+	// ErrStorage is returned when the datastore fails to store or delete an
+	// entry, or to read one it holds.
+	ErrStorage = errors.New("Storage failure")
+
+	// ErrBudgetExceeded is returned by calls stopped for going over the
+	// budget set with SetBudget.
+	ErrBudgetExceeded = errors.New("Bandwidth budget exceeded")
+
+	// ErrConcurrentModification is returned when another session changed an
+	// entry while a call was updating it. The call can be retried.
+	ErrConcurrentModification = errors.New("Concurrent modification")
+
+	// ErrUserDeleted is returned when logging in as, or inviting, a user who
+	// deleted their account.
+	ErrUserDeleted = errors.New("User deleted")
+
+	// ErrKeyChanged is returned when a user's published keys no longer match
+	// the ones pinned at first contact and were not certified by them. The
+	// new keys can be accepted with ConfirmContact after comparing
+	// fingerprints out of band.
+	ErrKeyChanged = errors.New("Public key changed")
+
+	// ErrNoRecovery is returned when starting or approving the recovery of an
+	// account that has not set recovery up with the trustee.
+	ErrNoRecovery = errors.New("Recovery not set up")
+
+	// ErrRecoveryIncomplete is returned by Complete while fewer trustees than
+	// the threshold have approved the recovery.
+	ErrRecoveryIncomplete = errors.New("Not enough trustees approved the recovery")
+
+	// ErrRollback is returned when the datastore hands out an entry older
+	// than one the user has already seen. It wraps ErrIntegrity.
+	ErrRollback = fmt.Errorf("%w: Rolled back to an older version", ErrIntegrity)
+)
+
+// An OpError records the User API call that failed and the file or user it
+// was about. Err wraps one of the sentinel errors above.
+type OpError struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	return e.Op + " " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps a failed API call in an OpError. Calls made on behalf of another API
+// call are reported under the outermost one.
+func setOp(op string, name string, err *error) {
+	if *err == nil {
+		return
+	}
+
+	if inner, ok := (*err).(*OpError); ok {
+		*err = inner.Err
+	}
+	*err = &OpError{op, name, *err}
+}
+
+// Classifies an error returned by userlib, keeping its message
+func wrapErr(kind error, err error) error {
+	return fmt.Errorf("%w: %v", kind, err)
+}
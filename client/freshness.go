@@ -0,0 +1,274 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Every write of a file's head raises its version, so a datastore replaying
+// an older head, e.g. to hide appends or undo a StoreFile, hands out a lower
+// version than the user has already seen. Every file the user has loaded or
+// written has a freshness record of its own, keyed by the head's UUID, that
+// holds the newest head version seen, so checking a head costs the same
+// however many files the user has. Each session also remembers the versions
+// it has seen, so it catches a head replayed along with its freshness record;
+// a new session only has the record to go by.
+
+type freshness struct {
+	Version int
+}
+
+func freshnessUUID(username string, key string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("freshness/"+key)...))[:16])
+}
+
+// Accounts from before layoutFileFreshness kept the versions of all their
+// files in a single record, which splitFreshness moves into records per file
+func sharedFreshnessUUID(username string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("freshness")...))[:16])
+}
+
+func decodeFreshness(data []byte) (record freshness, err error) {
+	if data == nil {
+		return record, nil
+	}
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return record, wrapErr(ErrIntegrity, err)
+	}
+	return record, nil
+}
+
+// Applies change to the freshness record under key, which is only stored if
+// change reports that it changed it. A file without a record has version 0.
+func (user *User) changeFreshness(key string, change func(record *freshness) (bool, error)) error {
+	u, err := freshnessUUID(user.Username, key)
+	if err != nil {
+		return err
+	}
+
+	return user.client.modify(u, kindFreshness, user.PersonalKey, func(data []byte) ([]byte, error) {
+		record, err := decodeFreshness(data)
+		if err != nil {
+			return nil, err
+		}
+
+		changed, err := change(&record)
+		if err != nil || !changed {
+			return nil, err
+		}
+		return json.Marshal(record)
+	})
+}
+
+// Moves the versions in the shared freshness record of an account from before
+// layoutFileFreshness into records per file, keeping any newer version a
+// session has recorded since, and deletes it. Records written before they had
+// a sequence number are a bare map.
+func (user *User) splitFreshness() error {
+	c := user.client
+	u, err := sharedFreshnessUUID(user.Username)
+	if err != nil {
+		return err
+	}
+
+	data, _, err := c.readEntry(u, kindFreshness, user.PersonalKey)
+	if err != nil || data == nil {
+		return err
+	}
+
+	var shared struct {
+		Seen map[string]int
+	}
+	err = json.Unmarshal(data, &shared)
+	if err == nil && shared.Seen == nil {
+		err = json.Unmarshal(data, &shared.Seen)
+	}
+	if err != nil {
+		return wrapErr(ErrIntegrity, err)
+	}
+
+	for key, version := range shared.Seen {
+		err = user.changeFreshness(key, func(record *freshness) (bool, error) {
+			if version <= record.Version {
+				return false, nil
+			}
+			record.Version = version
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.ds.Delete(u)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+	return nil
+}
+
+func headKey(file File) (string, error) {
+	u, err := idToUUID(file.Start)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Returns the newest version of file's head the user has seen
+func (user User) seenVersion(file File) (int, error) {
+	key, err := headKey(file)
+	if err != nil {
+		return 0, err
+	}
+
+	u, err := freshnessUUID(user.Username, key)
+	if err != nil {
+		return 0, err
+	}
+	data, _, err := user.client.readEntry(u, kindFreshness, user.PersonalKey)
+	if err != nil {
+		return 0, err
+	}
+
+	record, err := decodeFreshness(data)
+	if err != nil {
+		return 0, err
+	}
+	if user.heads[key] > record.Version {
+		return user.heads[key], nil
+	}
+	return record.Version, nil
+}
+
+// Remembers that the session has seen version of the head under key
+func (user *User) sawHead(key string, version int) {
+	if user.heads == nil {
+		user.heads = make(map[string]int)
+	}
+	if version > user.heads[key] {
+		user.heads[key] = version
+	}
+}
+
+// Fails with ErrRollback if head is older than a head of file the user or
+// the session has seen, and otherwise records it as seen
+func (user *User) checkFresh(file File, head Head) error {
+	key, err := headKey(file)
+	if err != nil {
+		return err
+	}
+
+	if head.Version < user.heads[key] {
+		return fmt.Errorf("%w: File head at version %d, %d seen before", ErrRollback, head.Version, user.heads[key])
+	}
+	user.sawHead(key, head.Version)
+
+	return user.changeFreshness(key, func(record *freshness) (bool, error) {
+		if head.Version < record.Version {
+			return false, fmt.Errorf("%w: File head at version %d, %d seen before", ErrRollback, head.Version, record.Version)
+		} else if head.Version == record.Version {
+			return false, nil
+		}
+
+		record.Version = head.Version
+		return true, nil
+	})
+}
+
+// Records head as seen unless a newer head of file has been seen, as it may
+// have been by another session writing the head after this one
+func (user *User) recordFresh(file File, head Head) error {
+	key, err := headKey(file)
+	if err != nil {
+		return err
+	}
+	user.sawHead(key, head.Version)
+
+	return user.changeFreshness(key, func(record *freshness) (bool, error) {
+		if head.Version <= record.Version {
+			return false, nil
+		}
+		record.Version = head.Version
+		return true, nil
+	})
+}
+
+// Loads the head of file, along with its entry, and checks it with
+// checkFresh. Another session may have moved the head on and recorded the
+// newer version between the load and the check, so a head found older is
+// loaded again for as long as its version keeps changing.
+func (user *User) loadFreshHead(file File) (head Head, raw []byte, err error) {
+	last := -1
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		head, raw, err = user.client.loadHead(file)
+		if err != nil {
+			return head, nil, err
+		}
+
+		err = user.checkFresh(file, head)
+		if !errors.Is(err, ErrRollback) || head.Version == last {
+			break
+		}
+		last = head.Version
+	}
+	return head, raw, err
+}
+
+// Deletes the freshness record of file once the user no longer has it
+func (user *User) forgetFresh(file File) error {
+	key, err := headKey(file)
+	if err != nil {
+		return err
+	}
+
+	u, err := freshnessUUID(user.Username, key)
+	if err != nil {
+		return err
+	}
+
+	delete(user.heads, key)
+	err = user.client.ds.Delete(u)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+	return nil
+}
+
+// ConfirmFile accepts the current head of filename as the newest the user has
+// seen, so that LoadFile no longer fails with ErrRollback for it. It is meant
+// for heads the user knows to be genuine, e.g. after the datastore was
+// restored from a backup.
+func (userdata *User) ConfirmFile(filename string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("ConfirmFile", filename)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+
+	file, err := userdata.getFile(filename)
+	if err != nil {
+		return err
+	}
+	head, _, err := userdata.client.loadHead(file)
+	if err != nil {
+		return err
+	}
+	key, err := headKey(file)
+	if err != nil {
+		return err
+	}
+
+	delete(userdata.heads, key)
+	userdata.sawHead(key, head.Version)
+	return userdata.changeFreshness(key, func(record *freshness) (bool, error) {
+		record.Version = head.Version
+		return true, nil
+	})
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// An Invitation is a pending share found in a user's inbox. Err is set,
+// and the other fields may be empty, for a slot that could not be read.
+type Invitation struct {
+	Sender   string
+	Filename string
+	Pointer  uuid.UUID
+	Err      error
+}
+
+// Plaintext of an inbox slot
+type inboxEntry struct {
+	Sender     string
+	Filename   string
+	Invitation uuid.UUID
+}
+
+// Hybrid ciphertext: Key is a fresh symmetric key under the recipient's public key
+type sealed struct {
+	Key     []byte
+	Payload []byte
+}
+
+// Returns the location of the i-th slot in recipient's inbox
+func inboxSlot(recipient string, i int) (uuid.UUID, error) {
+	id := append(userlib.Hash([]byte(recipient)), []byte("inbox/"+strconv.Itoa(i))...)
+	return uuid.FromBytes(userlib.Hash(id)[:16])
+}
+
+// Left by the recipient in slots whose invitation is gone, for senders to
+// reuse. Listing stops at the first empty slot, so slots are never emptied.
+var freeSlot = []byte("free")
+
+// Encrypts payload of any size to rec and signs the ciphertext with the user's
+// signature key
+func (user *User) seal(rec string, payload []byte) (bytes []byte, err error) {
+	eKey, version, err := user.client.encryptionKey(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	key := userlib.RandomBytes(16)
+	wrapped, err := userlib.PKEEnc(eKey, key)
+	if err != nil {
+		return nil, wrapErr(ErrCrypto, err)
+	}
+
+	enc, err := json.Marshal(sealed{wrapped, userlib.SymEnc(key, userlib.RandomBytes(16), payload)})
+	if err != nil {
+		return nil, err
+	}
+
+	wrap, err := user.sign(enc)
+	if err != nil {
+		return nil, err
+	}
+	wrap.Recipient = version
+	return json.Marshal(wrap)
+}
+
+// Decrypts a sealed envelope addressed to the user. The signature is returned
+// unchecked since the signer is only known once the payload is read.
+func (user *User) unseal(bytes []byte) (wrap Data, payload []byte, err error) {
+	err = json.Unmarshal(bytes, &wrap)
+	if err != nil {
+		return wrap, nil, wrapErr(ErrInvalidInvitation, err)
+	}
+
+	var s sealed
+	err = json.Unmarshal(wrap.Encrypted, &s)
+	if err != nil {
+		return wrap, nil, wrapErr(ErrInvalidInvitation, err)
+	}
+
+	dKey, err := user.decryptionKey(wrap.Recipient)
+	if err != nil {
+		return wrap, nil, wrapErr(ErrInvalidInvitation, err)
+	}
+
+	key, err := userlib.PKEDec(dKey, s.Key)
+	if err != nil {
+		return wrap, nil, wrapErr(ErrInvalidInvitation, err)
+	}
+
+	if len(s.Payload) < userlib.AESBlockSizeBytes {
+		return wrap, nil, fmt.Errorf("%w: Sealed payload too short", ErrInvalidInvitation)
+	}
+	return wrap, userlib.SymDec(key, s.Payload), nil
+}
+
+// Leaves a pointer to invitation u in the first free slot of rec's inbox. A
+// slot is claimed by swapping the entry in, so senders racing for it do not
+// overwrite each other.
+func (user *User) inboxStore(u uuid.UUID, rec string, filename string) error {
+	entry, err := json.Marshal(inboxEntry{user.Username, filename, u})
+	if err != nil {
+		return err
+	}
+
+	sealedEntry, err := user.seal(rec, entry)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i += 1 {
+		slot, err := inboxSlot(rec, i)
+		if err != nil {
+			return err
+		}
+
+		current, taken := user.client.ds.Get(slot)
+		if taken && !bytes.Equal(current, freeSlot) {
+			continue
+		}
+
+		err = user.client.swap(slot, current, sealedEntry)
+		if !errors.Is(err, ErrConcurrentModification) {
+			return err
+		}
+	}
+}
+
+// ListInvitations returns the invitations in the user's inbox that have not
+// been accepted yet. Slots that cannot be read are returned with Err set
+// rather than failing the call, and slots of invitations that are gone are
+// freed for reuse.
+func (userdata *User) ListInvitations() (invitations []Invitation, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("ListInvitations", userdata.Username)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i += 1 {
+		slot, err := inboxSlot(userdata.Username, i)
+		if err != nil {
+			return nil, err
+		}
+
+		raw, ok := userdata.client.ds.Get(slot)
+		if !ok {
+			return invitations, nil
+		} else if bytes.Equal(raw, freeSlot) {
+			continue
+		}
+
+		entry, err := userdata.readSlot(raw)
+		if errors.Is(err, ErrInvalidInvitation) || errors.Is(err, ErrKeyChanged) {
+			invitations = append(invitations, Invitation{entry.Sender, entry.Filename, entry.Invitation, err})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Accepted invitations are deleted, so their slots are stale
+		_, pending := userdata.client.ds.Get(entry.Invitation)
+		if pending {
+			invitations = append(invitations, Invitation{entry.Sender, entry.Filename, entry.Invitation, nil})
+			continue
+		}
+
+		err = userdata.client.swap(slot, raw, freeSlot)
+		if err != nil && !errors.Is(err, ErrConcurrentModification) {
+			return nil, err
+		}
+	}
+}
+
+// Opens an inbox slot and checks its sender, pinning them in the contact list
+func (userdata *User) readSlot(raw []byte) (entry inboxEntry, err error) {
+	wrap, data, err := userdata.unseal(raw)
+	if err != nil {
+		return entry, err
+	}
+
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return entry, wrapErr(ErrInvalidInvitation, err)
+	}
+
+	vKey, err := userdata.client.verifyKey(entry.Sender, wrap.Signer)
+	if err != nil {
+		return entry, fmt.Errorf("%w: Unknown sender %s: %v", ErrInvalidInvitation, entry.Sender, err)
+	}
+
+	err = userlib.DSVerify(vKey, wrap.Encrypted, wrap.Authenticator)
+	if err != nil {
+		return entry, wrapErr(ErrInvalidInvitation, err)
+	}
+	return entry, userdata.checkContact(entry.Sender)
+}
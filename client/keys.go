@@ -0,0 +1,257 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Keystore entries cannot be overwritten, so rotated key pairs are published
+// under new names: version 0 is username+"e" and username+"v" as set by
+// InitUser, and version n is username+"e#n" and username+"v#n". A version only
+// counts once a certificate signed by the previous version vouches for it, so
+// other users cannot squat on a user's next version.
+
+// Public keys of a version, signed by the version before it
+type keyCert struct {
+	Version      int
+	Encryption   userlib.PKEEncKey
+	Verification userlib.DSVerifyKey
+}
+
+func keyName(username string, kind string, version int) string {
+	if version == 0 {
+		return username + kind
+	}
+	return username + kind + "#" + strconv.Itoa(version)
+}
+
+func certUUID(username string, version int) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("key cert/"+strconv.Itoa(version))...))[:16])
+}
+
+// Returns the keys published as version n of username's keys, and whether
+// either of them is. Version walks stop at the first version with neither, so
+// that is where RotateKeys publishes, and a version squatted with one entry
+// only does not hide the versions after it.
+func (c *Client) publishedKeys(username string, n int) (eKey userlib.PKEEncKey, vKey userlib.DSVerifyKey, ok bool) {
+	eKey, e := c.ks.Get(keyName(username, "e", n))
+	vKey, v := c.ks.Get(keyName(username, "v", n))
+	return eKey, vKey, e || v
+}
+
+// Returns username's certified key versions, oldest first, along with the
+// newest version published, certified or not. The walk stops at the first
+// version with no keystore entries.
+func (c *Client) keyVersions(username string) (versions []int, published int, err error) {
+	versions = []int{0}
+	for n := 1; ; n += 1 {
+		eKey, vKey, ok := c.publishedKeys(username, n)
+		if !ok {
+			return versions, n - 1, nil
+		}
+
+		prev, ok := c.ks.Get(keyName(username, "v", versions[len(versions)-1]))
+		if !ok {
+			return nil, 0, ErrUserNotFound
+		}
+
+		if c.certified(username, n, prev, eKey, vKey) {
+			versions = append(versions, n)
+		}
+	}
+}
+
+// Reports whether version n's certificate is signed by prev and names the
+// keys published in the keystore
+func (c *Client) certified(username string, n int, prev userlib.DSVerifyKey, eKey userlib.PKEEncKey, vKey userlib.DSVerifyKey) bool {
+	u, err := certUUID(username, n)
+	if err != nil {
+		return false
+	}
+
+	data, ok := c.ds.Get(u)
+	if !ok {
+		return false
+	}
+
+	var wrap Data
+	var cert keyCert
+	if json.Unmarshal(data, &wrap) != nil || json.Unmarshal(wrap.Encrypted, &cert) != nil {
+		return false
+	}
+	if userlib.DSVerify(prev, wrap.Encrypted, wrap.Authenticator) != nil || cert.Version != n {
+		return false
+	}
+
+	published, err := json.Marshal(keyCert{n, eKey, vKey})
+	return err == nil && bytes.Equal(published, wrap.Encrypted)
+}
+
+func hasVersion(versions []int, version int) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns username's newest encryption key and its version
+func (c *Client) encryptionKey(username string) (key userlib.PKEEncKey, version int, err error) {
+	if c.retired(username) {
+		return key, 0, ErrUserDeleted
+	}
+
+	versions, _, err := c.keyVersions(username)
+	if err != nil {
+		return key, 0, err
+	}
+
+	version = versions[len(versions)-1]
+	key, ok := c.ks.Get(keyName(username, "e", version))
+	if !ok {
+		return key, 0, ErrUserNotFound
+	}
+	return key, version, nil
+}
+
+// Returns the key verifying username's signatures made with version, which
+// must be their newest certified version. Older keys may be why the user
+// rotated, and signatures made with them since cannot be told apart from the
+// ones made before, so records that outlive a rotation are signed again.
+func (c *Client) verifyKey(username string, version int) (key userlib.DSVerifyKey, err error) {
+	versions, _, err := c.keyVersions(username)
+	if err != nil {
+		return key, err
+	}
+
+	newest := versions[len(versions)-1]
+	if version != newest {
+		return key, fmt.Errorf("%w: Key version %d of %s is not their newest, %d", ErrIntegrity, version, username, newest)
+	}
+
+	key, ok := c.ks.Get(keyName(username, "v", version))
+	if !ok {
+		return key, ErrUserNotFound
+	}
+	return key, nil
+}
+
+// Returns the user's decryption key of version, reloading the user record
+// in case another session rotated to it
+func (user *User) decryptionKey(version int) (userlib.PKEDecKey, error) {
+	if version > user.KeyVersion {
+		err := user.refresh()
+		if err != nil {
+			return userlib.PKEDecKey{}, err
+		}
+	}
+
+	if version == user.KeyVersion {
+		return user.DecryptionKey, nil
+	}
+
+	key, ok := user.RetiredKeys[version]
+	if !ok {
+		return key, fmt.Errorf("%w: No decryption key of version %d", ErrIntegrity, version)
+	}
+	return key, nil
+}
+
+// Signs data with the user's current signature key
+func (user *User) sign(data []byte) (wrap Data, err error) {
+	sign, err := userlib.DSSign(user.SignatureKey, data)
+	if err != nil {
+		return wrap, wrapErr(ErrCrypto, err)
+	}
+	return Data{Encrypted: data, Authenticator: sign, Signer: user.KeyVersion}, nil
+}
+
+// RotateKeys replaces the user's encryption and signature key pairs, so that
+// leaked private keys stop being useful for new shares. Invitations sent to
+// the old encryption key can still be accepted, but signatures made with the
+// old signature key are no longer accepted: invitations the user sent before
+// have to be sent again, and the recovery setup is signed again.
+func (userdata *User) RotateKeys() (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("RotateKeys", userdata.Username)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+	c := userdata.client
+
+	signatureKey, verificationKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return wrapErr(ErrCrypto, err)
+	}
+
+	encryptionKey, decryptionKey, err := userlib.PKEKeyGen()
+	if err != nil {
+		return wrapErr(ErrCrypto, err)
+	}
+
+	// Skip versions someone else already published
+	n := userdata.KeyVersion + 1
+	for {
+		_, _, ok := c.publishedKeys(userdata.Username, n)
+		if !ok {
+			break
+		}
+		n += 1
+	}
+
+	cert, err := json.Marshal(keyCert{n, encryptionKey, verificationKey})
+	if err != nil {
+		return err
+	}
+
+	wrap, err := userdata.sign(cert)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(wrap)
+	if err != nil {
+		return err
+	}
+
+	u, err := certUUID(userdata.Username, n)
+	if err != nil {
+		return err
+	}
+
+	err = c.ds.Set(u, data)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+
+	err = c.ks.Set(keyName(userdata.Username, "v", n), verificationKey)
+	if err != nil {
+		return wrapErr(ErrNameTaken, err)
+	}
+
+	err = c.ks.Set(keyName(userdata.Username, "e", n), encryptionKey)
+	if err != nil {
+		return wrapErr(ErrNameTaken, err)
+	}
+
+	if userdata.RetiredKeys == nil {
+		userdata.RetiredKeys = make(map[int]userlib.PKEDecKey)
+	}
+	previous := userdata.KeyVersion
+	userdata.RetiredKeys[userdata.KeyVersion] = userdata.DecryptionKey
+	userdata.DecryptionKey = decryptionKey
+	userdata.SignatureKey = signatureKey
+	userdata.KeyVersion = n
+	err = userdata.storeUser()
+	if err != nil {
+		return err
+	}
+	return userdata.resignRecovery(previous)
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// MemoryDatastore is a Datastore kept in process memory, safe for concurrent use.
+type MemoryDatastore struct {
+	mu      sync.Mutex
+	entries map[uuid.UUID][]byte
+}
+
+func NewMemoryDatastore() *MemoryDatastore {
+	return &MemoryDatastore{entries: make(map[uuid.UUID][]byte)}
+}
+
+func (d *MemoryDatastore) Get(u uuid.UUID) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	value, ok := d.entries[u]
+	return append([]byte(nil), value...), ok
+}
+
+func (d *MemoryDatastore) Set(u uuid.UUID, value []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[u] = append([]byte(nil), value...)
+	return nil
+}
+
+func (d *MemoryDatastore) Delete(u uuid.UUID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.entries, u)
+	return nil
+}
+
+func (d *MemoryDatastore) CompareAndSwap(u uuid.UUID, old []byte, value []byte) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current, ok := d.entries[u]
+	if ok != (old != nil) || !bytes.Equal(current, old) {
+		return false, nil
+	}
+
+	if value == nil {
+		delete(d.entries, u)
+	} else {
+		d.entries[u] = append([]byte(nil), value...)
+	}
+	return true, nil
+}
+
+// MemoryKeystore is a Keystore kept in process memory, safe for concurrent use.
+type MemoryKeystore struct {
+	mu   sync.Mutex
+	keys map[string]userlib.PublicKeyType
+}
+
+func NewMemoryKeystore() *MemoryKeystore {
+	return &MemoryKeystore{keys: make(map[string]userlib.PublicKeyType)}
+}
+
+func (k *MemoryKeystore) Get(name string) (userlib.PublicKeyType, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	value, ok := k.keys[name]
+	return value, ok
+}
+
+func (k *MemoryKeystore) Set(name string, value userlib.PublicKeyType) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, taken := k.keys[name]; taken {
+		return errors.New("Entry in keystore has been taken")
+	}
+	k.keys[name] = value
+	return nil
+}
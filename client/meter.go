@@ -0,0 +1,198 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Usage counts the datastore traffic of an API call.
+type Usage struct {
+	BytesRead    int
+	BytesWritten int
+	RoundTrips   int
+}
+
+func (u Usage) sub(v Usage) Usage {
+	return Usage{u.BytesRead - v.BytesRead, u.BytesWritten - v.BytesWritten, u.RoundTrips - v.RoundTrips}
+}
+
+func (u Usage) add(v Usage) Usage {
+	return Usage{u.BytesRead + v.BytesRead, u.BytesWritten + v.BytesWritten, u.RoundTrips + v.RoundTrips}
+}
+
+// Whether u goes over budget. Zero fields of budget are unlimited.
+func (u Usage) over(budget Usage) bool {
+	return (budget.BytesRead > 0 && u.BytesRead > budget.BytesRead) ||
+		(budget.BytesWritten > 0 && u.BytesWritten > budget.BytesWritten) ||
+		(budget.RoundTrips > 0 && u.RoundTrips > budget.RoundTrips)
+}
+
+// Counts the traffic of one session, and remembers reads that failed. Nested
+// API calls are charged to the outermost call, which is the one the budget
+// applies to.
+type meter struct {
+	mu       sync.Mutex
+	total    Usage
+	start    Usage // total when the outermost call began
+	depth    int
+	budget   Usage
+	exceeded bool
+	failed   error // first read of the outermost call that failed
+	last     Usage
+}
+
+func (m *meter) begin() (snapshot Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.depth == 0 {
+		m.start = m.total
+	}
+	m.depth += 1
+	return m.total
+}
+
+// Ends the call begun at snapshot, returning its usage. exceeded and failed
+// are only reported to the outermost call.
+func (m *meter) end(snapshot Usage) (usage Usage, exceeded bool, failed error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depth -= 1
+	usage = m.total.sub(snapshot)
+	if m.depth == 0 {
+		exceeded, m.exceeded = m.exceeded, false
+		failed, m.failed = m.failed, nil
+		m.last = usage
+	}
+	return usage, exceeded, failed
+}
+
+// Records that a read failed with err, so the call's later writes are refused
+func (m *meter) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.depth > 0 && m.failed == nil {
+		m.failed = err
+	}
+}
+
+// Returns the error of the current call's first failed read, or nil if none
+// failed. The call then fails with it wrapped in ErrStorage.
+func (m *meter) failure() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failed
+}
+
+// Charges an operation to the current call, refusing it if that would go
+// over budget. Reads are charged once their size is known.
+func (m *meter) charge(read int, written int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := m.total
+	next.BytesRead += read
+	next.BytesWritten += written
+	next.RoundTrips += 1
+	if m.exceeded || (m.depth > 0 && next.sub(m.start).over(m.budget)) {
+		m.exceeded = true
+		return false
+	}
+	m.total = next
+	return true
+}
+
+// Whether the current call can still spend cost without going over budget
+func (m *meter) affords(cost Usage) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.exceeded && (m.depth == 0 || !m.total.sub(m.start).add(cost).over(m.budget))
+}
+
+// Fails with ErrBudgetExceeded unless the current call can still spend cost,
+// so that a call can check writes against the budget before it starts them
+func (c *Client) afford(cost Usage) error {
+	if !c.meter.affords(cost) {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
+
+// Charges every datastore operation to a session's meter
+type meteredDatastore struct {
+	ds Datastore
+	m  *meter
+}
+
+// Get reports an entry that would go over budget, or that could not be read,
+// as missing; the call then fails with ErrBudgetExceeded or ErrStorage.
+func (d meteredDatastore) Get(u uuid.UUID) ([]byte, bool) {
+	value, ok, err := lookup(d.ds, u)
+	if !d.m.charge(len(value), 0) {
+		return nil, false
+	}
+	if err != nil {
+		d.m.fail(err)
+		return nil, false
+	}
+	return value, ok
+}
+
+func (d meteredDatastore) Set(u uuid.UUID, value []byte) error {
+	if err := d.m.failure(); err != nil {
+		return err
+	}
+	if !d.m.charge(0, len(value)) {
+		return ErrBudgetExceeded
+	}
+	return d.ds.Set(u, value)
+}
+
+func (d meteredDatastore) Delete(u uuid.UUID) error {
+	if err := d.m.failure(); err != nil {
+		return err
+	}
+	if !d.m.charge(0, 0) {
+		return ErrBudgetExceeded
+	}
+	return d.ds.Delete(u)
+}
+
+func (d meteredDatastore) CompareAndSwap(u uuid.UUID, old []byte, value []byte) (bool, error) {
+	if err := d.m.failure(); err != nil {
+		return false, err
+	}
+	if !d.m.charge(0, len(value)) {
+		return false, ErrBudgetExceeded
+	}
+	return compareAndSwap(d.ds, u, old, value)
+}
+
+// Returns a copy of c whose datastore traffic is metered for one session
+func (c *Client) session() *Client {
+	s := *c
+	s.meter = &meter{}
+	s.ds = meteredDatastore{c.ds, s.meter}
+	return &s
+}
+
+// LastUsage returns the datastore traffic of the user's last API call,
+// including the calls it made on its own behalf.
+func (userdata *User) LastUsage() Usage {
+	userdata.client.meter.mu.Lock()
+	defer userdata.client.meter.mu.Unlock()
+	return userdata.client.meter.last
+}
+
+// SetBudget limits the datastore traffic of each of the user's later API
+// calls. A call that would go over budget is stopped and fails with
+// ErrBudgetExceeded. Calls that write file content check it against the
+// budget before writing anything; other calls may be stopped after some of
+// their writes were made, but never leave a file without either its old or
+// its new content. A revocation stopped part way may leave the file
+// unreadable until it is revoked again. Zero fields are unlimited, so SetBudget(Usage{}) removes
+// the budget.
+func (userdata *User) SetBudget(budget Usage) {
+	userdata.client.meter.mu.Lock()
+	defer userdata.client.meter.mu.Unlock()
+	userdata.client.meter.budget = budget
+}
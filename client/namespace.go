@@ -0,0 +1,89 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// The namespace record lists the user's filenames so that the account can be
+// walked without knowing them in advance.
+func namespaceUUID(username string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("namespace")...))[:16])
+}
+
+func (user User) loadNamespace() (names []string, err error) {
+	u, err := namespaceUUID(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := user.client.decryptGetData(u, kindNamespace, user.PersonalKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(bytes, &names)
+	if err != nil {
+		return nil, wrapErr(ErrIntegrity, err)
+	}
+	return names, nil
+}
+
+// Applies change to the namespace. change returns nil to leave it as is.
+func (user User) changeNamespace(change func(names []string) []string) error {
+	u, err := namespaceUUID(user.Username)
+	if err != nil {
+		return err
+	}
+
+	return user.client.modify(u, kindNamespace, user.PersonalKey, func(data []byte) ([]byte, error) {
+		if data == nil {
+			return nil, fmt.Errorf("%w: Namespace unavailable", ErrIntegrity)
+		}
+
+		var names []string
+		err := json.Unmarshal(data, &names)
+		if err != nil {
+			return nil, wrapErr(ErrIntegrity, err)
+		}
+
+		names = change(names)
+		if names == nil {
+			return nil, nil
+		}
+		return json.Marshal(names)
+	})
+}
+
+func (user User) addToNamespace(filename string) error {
+	return user.changeNamespace(func(names []string) []string {
+		for _, name := range names {
+			if name == filename {
+				return nil
+			}
+		}
+		return append(names, filename)
+	})
+}
+
+func (user User) removeFromNamespace(filename string) error {
+	return user.changeNamespace(func(names []string) []string {
+		for i, name := range names {
+			if name == filename {
+				return append(names[:i], names[i+1:]...)
+			}
+		}
+		return nil
+	})
+}
+
+// ListFiles returns the names of the files in the user's namespace, both
+// owned and shared, in the order they were added.
+func (userdata *User) ListFiles() (names []string, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("ListFiles", userdata.Username)(&err)
+	return userdata.loadNamespace()
+}
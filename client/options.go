@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A Datastore holds the client's encrypted entries. It is untrusted: entries
+// may be read, changed or deleted by anyone.
+type Datastore interface {
+	Get(u uuid.UUID) (value []byte, ok bool)
+	Set(u uuid.UUID, value []byte) error
+	Delete(u uuid.UUID) error
+}
+
+// A ConditionalDatastore can also replace an entry only if it still holds
+// what it held when it was read, in one step. Clients use it to catch writes
+// made by other devices to the records a call rewrites. Over a plain
+// Datastore they compare and set in two steps, which narrows the window for
+// lost updates without closing it.
+type ConditionalDatastore interface {
+	Datastore
+
+	// CompareAndSwap sets u to value, or deletes it if value is nil, if u
+	// holds old, or is missing when old is nil, and reports whether it did.
+	CompareAndSwap(u uuid.UUID, old []byte, value []byte) (swapped bool, err error)
+}
+
+// A CheckedDatastore can also tell an entry that is missing from one that
+// could not be read. Once a read fails, clients refuse to write for the rest
+// of the call and fail it with ErrStorage, so an entry that could not be read
+// is never taken for a missing one and overwritten.
+type CheckedDatastore interface {
+	Datastore
+
+	// Lookup is Get, but fails if u may be there but could not be read.
+	Lookup(u uuid.UUID) (value []byte, ok bool, err error)
+}
+
+// Reads u from ds, with the error if ds can tell it apart from a missing entry
+func lookup(ds Datastore, u uuid.UUID) (value []byte, ok bool, err error) {
+	if cds, ok := ds.(CheckedDatastore); ok {
+		return cds.Lookup(u)
+	}
+	value, ok = ds.Get(u)
+	return value, ok, nil
+}
+
+// Swaps u from old to value on ds, in two steps if ds cannot do it in one
+func compareAndSwap(ds Datastore, u uuid.UUID, old []byte, value []byte) (swapped bool, err error) {
+	if cds, ok := ds.(ConditionalDatastore); ok {
+		return cds.CompareAndSwap(u, old, value)
+	}
+
+	current, ok, err := lookup(ds, u)
+	if err != nil {
+		return false, err
+	}
+	if ok != (old != nil) || !bytes.Equal(current, old) {
+		return false, nil
+	}
+	if value == nil {
+		return true, ds.Delete(u)
+	}
+	return true, ds.Set(u, value)
+}
+
+// A Keystore publishes users' public keys. Set fails for a name that is
+// already taken.
+type Keystore interface {
+	Get(name string) (value userlib.PublicKeyType, ok bool)
+	Set(name string, value userlib.PublicKeyType) error
+}
+
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// Options configure a Client. Zero fields take the defaults used by the
+// package-level InitUser and GetUser.
+type Options struct {
+	Datastore Datastore
+	Keystore  Keystore
+
+	// Length of the key derived from a password. The first 32 bytes wrap the
+	// user's master key; at least 32 are required. Defaults to 64.
+	PasswordKeyLen uint32
+
+	// Costs of deriving keys from passwords for new accounts and password
+	// changes. Accounts with lower costs are upgraded on their next login.
+	// Defaults to the costs of userlib.Argon2Key.
+	KDF KDFParams
+
+	Logger Logger
+	Clock  func() time.Time
+
+	// Tracer observes every API call and store operation. Defaults to NopTracer.
+	Tracer Tracer
+}
+
+// A Client creates and logs in users against one datastore and keystore.
+// Users returned by a Client only ever touch that Client's stores.
+type Client struct {
+	ds     Datastore
+	ks     Keystore
+	keyLen uint32
+	kdf    KDFParams
+	log    Logger
+	now    func() time.Time
+	tracer Tracer
+	meter  *meter // set on the copies made for each session
+	legacy bool   // whether entries without a header are opened, see layoutEnvelope
+
+	accounts *accountLocks
+}
+
+// NewClient returns a Client configured by opts.
+func NewClient(opts Options) (*Client, error) {
+	c := Client{opts.Datastore, opts.Keystore, opts.PasswordKeyLen, opts.KDF, opts.Logger, opts.Clock, opts.Tracer, nil, false, &accountLocks{locks: make(map[string]*sync.Mutex)}}
+	if c.ds == nil {
+		c.ds = userlibDatastore{}
+	}
+	if c.ks == nil {
+		c.ks = userlibKeystore{}
+	}
+	if c.keyLen == 0 {
+		c.keyLen = 64
+	} else if c.keyLen < 32 {
+		return nil, fmt.Errorf("%w: PasswordKeyLen must be at least 32", ErrInvalidArgument)
+	}
+	if c.kdf == (KDFParams{}) {
+		c.kdf = defaultKDF
+	} else if c.kdf.Time < 1 || c.kdf.Threads < 1 || c.kdf.Memory < 8*uint32(c.kdf.Threads) {
+		return nil, fmt.Errorf("%w: KDF needs a Time and Threads of at least 1 and 8 KiB of Memory per thread", ErrInvalidArgument)
+	}
+	if c.log == nil {
+		c.log = debugLogger{}
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	if c.tracer == nil {
+		c.tracer = NopTracer{}
+	} else {
+		c.ds = tracedDatastore{c.ds, &c}
+		c.ks = tracedKeystore{c.ks, &c}
+	}
+	return &c, nil
+}
+
+// Backs the package-level InitUser and GetUser and their keyfile variants
+var defaultClient, _ = NewClient(Options{})
+
+func InitUser(username string, password string) (userdataptr *User, err error) {
+	return defaultClient.InitUser(username, password)
+}
+
+func GetUser(username string, password string) (userdataptr *User, err error) {
+	return defaultClient.GetUser(username, password)
+}
+
+func InitUserWithKeyfile(username string, password string) (userdataptr *User, keyfile []byte, err error) {
+	return defaultClient.InitUserWithKeyfile(username, password)
+}
+
+func GetUserWithKeyfile(username string, password string, keyfile []byte) (userdataptr *User, err error) {
+	return defaultClient.GetUserWithKeyfile(username, password, keyfile)
+}
+
+// The global stores provided by userlib
+type userlibDatastore struct{}
+
+func (userlibDatastore) Get(u uuid.UUID) ([]byte, bool) {
+	return userlib.DatastoreGet(u)
+}
+
+func (userlibDatastore) Set(u uuid.UUID, value []byte) error {
+	userlib.DatastoreSet(u, value)
+	return nil
+}
+
+func (userlibDatastore) Delete(u uuid.UUID) error {
+	userlib.DatastoreDelete(u)
+	return nil
+}
+
+type userlibKeystore struct{}
+
+func (userlibKeystore) Get(name string) (userlib.PublicKeyType, bool) {
+	return userlib.KeystoreGet(name)
+}
+
+func (userlibKeystore) Set(name string, value userlib.PublicKeyType) error {
+	return userlib.KeystoreSet(name, value)
+}
+
+type debugLogger struct{}
+
+func (debugLogger) Printf(format string, args ...interface{}) {
+	userlib.DebugMsg(format, args...)
+}
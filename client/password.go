@@ -0,0 +1,307 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
+)
+
+// KDFParams are the Argon2id costs used to derive keys from passwords.
+// Memory is in KiB.
+type KDFParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// The costs of userlib.Argon2Key, which derived every password key before
+// KDF records were added
+var defaultKDF = KDFParams{1, 64 * 1024, 4}
+
+// Reports whether p costs less than target in any respect
+func (p KDFParams) weaker(target KDFParams) bool {
+	return p.Time < target.Time || p.Memory < target.Memory || p.Threads < target.Threads
+}
+
+// The KDF record is public: it holds the algorithm, costs and salt that turn
+// the user's password into the key wrapping their master key. Accounts
+// created before KDF records have none, and use the default costs with the
+// username as salt.
+type kdfRecord struct {
+	Alg string
+	KDFParams
+	Salt    []byte
+	Keyfile bool `json:",omitempty"` // the wrapping key also needs a keyfile
+
+	stored bool
+}
+
+func kdfRecordUUID(username string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("kdf")...))[:16])
+}
+
+func (c *Client) loadKDF(username string) (rec kdfRecord, err error) {
+	rec, _, err = c.loadKDFEntry(username)
+	return rec, err
+}
+
+// Like loadKDF, also returning the record as stored, or nil if there is none
+func (c *Client) loadKDFEntry(username string) (rec kdfRecord, raw []byte, err error) {
+	u, err := kdfRecordUUID(username)
+	if err != nil {
+		return rec, nil, err
+	}
+
+	raw, ok := c.ds.Get(u)
+	if !ok {
+		return kdfRecord{"argon2id", defaultKDF, []byte(username), false, false}, nil, nil
+	}
+
+	err = json.Unmarshal(raw, &rec)
+	if err != nil {
+		return rec, raw, wrapErr(ErrIntegrity, err)
+	}
+
+	// Costs are bounded so a tampered record cannot stall the client
+	if rec.Alg != "argon2id" || rec.Time < 1 || rec.Time > 64 || rec.Threads < 1 || rec.Memory < 8*uint32(rec.Threads) || rec.Memory > 1024*1024 || len(rec.Salt) < 16 {
+		return rec, raw, fmt.Errorf("%w: Unusable KDF record", ErrIntegrity)
+	}
+	rec.stored = true
+	return rec, raw, nil
+}
+
+// The key record holds the user's master key (PersonalKey) wrapped under the
+// key derived from their password, so that only this record depends on the
+// password. It is stored under the KDF salt, so a new one can be written
+// before the KDF record is switched over to it.
+func (rec kdfRecord) keyRecordUUID(username string) (uuid.UUID, error) {
+	id := append(userlib.Hash([]byte(username)), []byte("key record")...)
+	if rec.stored {
+		id = append(id, rec.Salt...)
+	}
+	return uuid.FromBytes(userlib.Hash(id)[:16])
+}
+
+func (c *Client) passwordKey(password string, rec kdfRecord) []byte {
+	return argon2.IDKey([]byte(password), rec.Salt, rec.Time, rec.Memory, rec.Threads, c.keyLen)[:32]
+}
+
+// Returns the key wrapping the master key, mixing in the keyfile for
+// accounts that have one
+func (c *Client) wrappingKey(password string, keyfile []byte, rec kdfRecord) ([]byte, error) {
+	pwKey := c.passwordKey(password, rec)
+	if !rec.Keyfile {
+		return pwKey, nil
+	}
+
+	key, err := userlib.HashKDF(pwKey[:16], append([]byte("keyfile"), keyfile...))
+	if err != nil {
+		return nil, wrapErr(ErrCrypto, err)
+	}
+	return key[:32], nil
+}
+
+// Unwraps the master key with password and, if the account has one, keyfile.
+// Accounts created before key records have none, and their master key is
+// the password key itself. The KDF record is returned so the caller can tell
+// whether the key record is due for an upgrade.
+func (c *Client) masterKey(username string, password string, keyfile []byte) (master []byte, rec kdfRecord, err error) {
+	rec, err = c.loadKDF(username)
+	if err != nil {
+		return nil, rec, err
+	}
+
+	if rec.Keyfile && keyfile == nil {
+		return nil, rec, ErrKeyfileRequired
+	}
+
+	u, err := rec.keyRecordUUID(username)
+	if err != nil {
+		return nil, rec, err
+	}
+
+	key, err := c.wrappingKey(password, keyfile, rec)
+	if err != nil {
+		return nil, rec, err
+	}
+
+	_, ok := c.ds.Get(u)
+	if !ok && !rec.stored {
+		return key, rec, nil
+	}
+
+	master, err = c.decryptGetData(u, kindKeyRecord, key)
+	if errors.Is(err, ErrIntegrity) {
+		return nil, rec, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, rec, err
+	}
+
+	if len(master) != 32 {
+		return nil, rec, fmt.Errorf("%w: Malformed key record", ErrIntegrity)
+	}
+	return master, rec, nil
+}
+
+// Wraps master under password and keyfile, which may be nil, with a fresh
+// salt and the client's KDF costs, then switches the KDF record over and
+// drops the old key record, returning the new KDF record. If another session
+// switched the KDF record in the meantime, the new key record is dropped
+// instead and the call fails with ErrConcurrentModification.
+func (c *Client) storeKeyRecord(username string, master []byte, password string, keyfile []byte) (rec kdfRecord, err error) {
+	old, raw, err := c.loadKDFEntry(username)
+	if err != nil {
+		old = kdfRecord{}
+	}
+
+	rec = kdfRecord{"argon2id", c.kdf, userlib.RandomBytes(16), keyfile != nil, true}
+	u, err := rec.keyRecordUUID(username)
+	if err != nil {
+		return rec, err
+	}
+
+	key, err := c.wrappingKey(password, keyfile, rec)
+	if err != nil {
+		return rec, err
+	}
+
+	err = c.encryptStoreInDS(u, kindKeyRecord, master, key)
+	if err != nil {
+		return rec, err
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return rec, err
+	}
+
+	created := u
+	u, err = kdfRecordUUID(username)
+	if err != nil {
+		return rec, err
+	}
+
+	err = c.swap(u, raw, data)
+	if errors.Is(err, ErrConcurrentModification) {
+		c.ds.Delete(created)
+		return rec, err
+	} else if err != nil {
+		return rec, err
+	}
+
+	if old.Alg == "" {
+		return rec, nil
+	}
+	u, err = old.keyRecordUUID(username)
+	if err != nil {
+		return rec, err
+	}
+
+	err = c.ds.Delete(u)
+	if err != nil {
+		return rec, wrapErr(ErrStorage, err)
+	}
+	return rec, nil
+}
+
+// ChangePassword rewraps the user's master key under newPassword. Files,
+// shares and other sessions are unaffected.
+func (userdata *User) ChangePassword(oldPassword string, newPassword string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("ChangePassword", userdata.Username)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+	c := userdata.client
+	err = userdata.checkPassword(oldPassword)
+	if err != nil {
+		return err
+	}
+	_, err = c.storeKeyRecord(userdata.Username, userdata.PersonalKey, newPassword, userdata.keyfile)
+	return err
+}
+
+// Fails unless password, with the session's keyfile, unwraps the session's
+// master key
+func (userdata *User) checkPassword(password string) error {
+	master, _, err := userdata.client.masterKey(userdata.Username, password, userdata.keyfile)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(master, userdata.PersonalKey) {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// EnrollKeyfile makes a new keyfile necessary, along with password, to log
+// in, replacing any earlier keyfile. Sessions logged in without the new
+// keyfile cannot change the password until they log in again.
+func (userdata *User) EnrollKeyfile(password string) (keyfile []byte, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("EnrollKeyfile", userdata.Username)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return nil, err
+	}
+	err = userdata.checkPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	keyfile = userlib.RandomBytes(32)
+	_, err = userdata.client.storeKeyRecord(userdata.Username, userdata.PersonalKey, password, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	userdata.keyfile = keyfile
+	return keyfile, nil
+}
+
+// RemoveKeyfile lets the user log in with their password alone again.
+func (userdata *User) RemoveKeyfile(password string) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("RemoveKeyfile", userdata.Username)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+	err = userdata.checkPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = userdata.client.storeKeyRecord(userdata.Username, userdata.PersonalKey, password, nil)
+	if err != nil {
+		return err
+	}
+	userdata.keyfile = nil
+	return nil
+}
+
+// LoginCurrent reports whether the password and keyfile the session logged in
+// with still log in to the account. They stop doing so once any session,
+// this one included, changes the password or keyfile or deletes the account.
+// It may also report false after a login re-wrapped the master key under
+// new KDF costs, in which case logging in again succeeds.
+func (userdata *User) LoginCurrent() (current bool, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("LoginCurrent", userdata.Username)(&err)
+	c := userdata.client
+	if c.retired(userdata.Username) {
+		return false, nil
+	}
+
+	rec, err := c.loadKDF(userdata.Username)
+	if err != nil {
+		return false, err
+	}
+	return rec.stored && bytes.Equal(rec.Salt, userdata.salt), nil
+}
@@ -0,0 +1,503 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Social recovery: the master key is wrapped under a random recovery key,
+// which is split into one share per trustee. A share is sealed to its
+// trustee and signed by the user. To recover, the user publishes a request
+// holding a fresh public key; trustees re-encrypt their share to it, and once
+// threshold of them have, the master key is wrapped under a new password.
+
+// Signed by the user; lists who holds the shares of the recovery key
+type recoveryConfig struct {
+	Threshold int
+	Trustees  []string
+}
+
+// Plaintext sealed to a trustee
+type recoveryShare struct {
+	Owner string
+	Share []byte
+}
+
+// A request is stored at the hash of its own bytes, so trustees can check
+// that the key they encrypt to is the one the requester made
+type recoveryRequest struct {
+	Username string
+	Key      userlib.PKEEncKey
+}
+
+func recoveryUUID(username string, purpose string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("recovery"+purpose)...))[:16])
+}
+
+// Location of trustee's approval of request
+func approvalUUID(request uuid.UUID, trustee string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(request[:], []byte(trustee)...))[:16])
+}
+
+// SetupRecovery lets any threshold of trustees approve a recovery of the
+// account. It replaces an earlier setup, whose shares stop working.
+func (userdata *User) SetupRecovery(trustees []string, threshold int) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("SetupRecovery", userdata.Username)(&err)
+	err = userdata.refresh()
+	if err != nil {
+		return err
+	}
+	c := userdata.client
+	if threshold < 1 || threshold > len(trustees) || len(trustees) > 255 {
+		return fmt.Errorf("%w: Threshold %d invalid for %d trustees", ErrInvalidArgument, threshold, len(trustees))
+	}
+
+	seen := make(map[string]bool)
+	for _, trustee := range trustees {
+		if trustee == userdata.Username || seen[trustee] {
+			return fmt.Errorf("%w: Trustee %s given twice or is the user", ErrInvalidArgument, trustee)
+		}
+		seen[trustee] = true
+		if !c.userExists(trustee) {
+			return ErrUserNotFound
+		}
+
+		err = userdata.checkContact(trustee)
+		if err != nil {
+			return err
+		}
+	}
+
+	old, err := c.loadRecoveryConfig(userdata.Username)
+	if err != nil && !errors.Is(err, ErrNoRecovery) {
+		return err
+	}
+
+	recoveryKey := userlib.RandomBytes(32)
+	for i, share := range split(recoveryKey, len(trustees), threshold) {
+		payload, err := json.Marshal(recoveryShare{userdata.Username, share})
+		if err != nil {
+			return err
+		}
+
+		sealed, err := userdata.seal(trustees[i], payload)
+		if err != nil {
+			return err
+		}
+
+		u, err := recoveryUUID(userdata.Username, "/"+trustees[i])
+		if err != nil {
+			return err
+		}
+
+		err = c.ds.Set(u, sealed)
+		if err != nil {
+			return wrapErr(ErrStorage, err)
+		}
+	}
+
+	u, err := recoveryUUID(userdata.Username, " key")
+	if err != nil {
+		return err
+	}
+
+	err = c.encryptStoreInDS(u, kindRecoveryKey, userdata.PersonalKey, recoveryKey)
+	if err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(recoveryConfig{threshold, trustees})
+	if err != nil {
+		return err
+	}
+
+	wrap, err := userdata.sign(config)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(wrap)
+	if err != nil {
+		return err
+	}
+
+	u, err = recoveryUUID(userdata.Username, "")
+	if err != nil {
+		return err
+	}
+
+	err = c.ds.Set(u, bytes)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+
+	for _, trustee := range old.Trustees {
+		if !seen[trustee] {
+			u, err := recoveryUUID(userdata.Username, "/"+trustee)
+			if err != nil {
+				return err
+			}
+
+			err = c.ds.Delete(u)
+			if err != nil {
+				return wrapErr(ErrStorage, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Loads the user's recovery setup, checking their signature
+func (c *Client) loadRecoveryConfig(username string) (config recoveryConfig, err error) {
+	u, err := recoveryUUID(username, "")
+	if err != nil {
+		return config, err
+	}
+
+	bytes, ok := c.ds.Get(u)
+	if !ok {
+		return config, ErrNoRecovery
+	}
+
+	var wrap Data
+	err = json.Unmarshal(bytes, &wrap)
+	if err != nil {
+		return config, wrapErr(ErrIntegrity, err)
+	}
+
+	vKey, err := c.verifyKey(username, wrap.Signer)
+	if err != nil {
+		return config, err
+	}
+
+	err = userlib.DSVerify(vKey, wrap.Encrypted, wrap.Authenticator)
+	if err != nil {
+		return config, wrapErr(ErrIntegrity, err)
+	}
+
+	err = json.Unmarshal(wrap.Encrypted, &config)
+	if err != nil {
+		return config, wrapErr(ErrIntegrity, err)
+	}
+	return config, nil
+}
+
+// Signs the recovery setup and the shares sealed to the trustees again with
+// the user's current signature key, after a rotation from version previous.
+// Only entries signed with previous are signed again, so nothing forged with
+// a key the user rotated away from earlier is vouched for.
+func (userdata *User) resignRecovery(previous int) error {
+	c := userdata.client
+	vKey, ok := c.ks.Get(keyName(userdata.Username, "v", previous))
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	u, err := recoveryUUID(userdata.Username, "")
+	if err != nil {
+		return err
+	}
+
+	data, err := userdata.resign(u, previous, vKey)
+	if err != nil || data == nil {
+		return err
+	}
+
+	var config recoveryConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return wrapErr(ErrIntegrity, err)
+	}
+
+	for _, trustee := range config.Trustees {
+		u, err := recoveryUUID(userdata.Username, "/"+trustee)
+		if err != nil {
+			return err
+		}
+
+		_, err = userdata.resign(u, previous, vKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Signs the entry at u, which must have been signed with version previous as
+// checked by vKey, again with the user's current signature key. Returns what
+// was signed, or nil if there is no entry.
+func (userdata *User) resign(u uuid.UUID, previous int, vKey userlib.DSVerifyKey) (data []byte, err error) {
+	c := userdata.client
+	raw, ok := c.ds.Get(u)
+	if !ok {
+		return nil, nil
+	}
+
+	var wrap Data
+	err = json.Unmarshal(raw, &wrap)
+	if err != nil {
+		return nil, wrapErr(ErrIntegrity, err)
+	}
+
+	if wrap.Signer != previous || userlib.DSVerify(vKey, wrap.Encrypted, wrap.Authenticator) != nil {
+		return nil, fmt.Errorf("%w: Recovery entry not signed with key version %d", ErrIntegrity, previous)
+	}
+
+	signed, err := userdata.sign(wrap.Encrypted)
+	if err != nil {
+		return nil, err
+	}
+	signed.Recipient = wrap.Recipient
+
+	raw, err = json.Marshal(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.ds.Set(u, raw)
+	if err != nil {
+		return nil, wrapErr(ErrStorage, err)
+	}
+	return wrap.Encrypted, nil
+}
+
+// A Recovery is a pending request to recover an account. Its ID is handed to
+// the trustees, who approve it with ApproveRecovery.
+type Recovery struct {
+	ID       uuid.UUID
+	username string
+	key      userlib.PKEDecKey
+	client   *Client
+}
+
+func StartRecovery(username string) (recovery *Recovery, err error) {
+	return defaultClient.StartRecovery(username)
+}
+
+// StartRecovery publishes a request to recover username's account.
+func (c *Client) StartRecovery(username string) (recovery *Recovery, err error) {
+	c = c.session()
+	defer c.trace("StartRecovery", username, username)(&err)
+	_, err = c.loadRecoveryConfig(username)
+	if err != nil {
+		return nil, err
+	}
+
+	eKey, dKey, err := userlib.PKEKeyGen()
+	if err != nil {
+		return nil, wrapErr(ErrCrypto, err)
+	}
+
+	bytes, err := json.Marshal(recoveryRequest{username, eKey})
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.FromBytes(userlib.Hash(bytes)[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.ds.Set(id, bytes)
+	if err != nil {
+		return nil, wrapErr(ErrStorage, err)
+	}
+	return &Recovery{id, username, dKey, c}, nil
+}
+
+// ApproveRecovery hands the user's share of username's recovery key to the
+// requester of request. Trustees should first make sure, outside the system,
+// that the request really comes from username.
+func (userdata *User) ApproveRecovery(username string, request uuid.UUID) (err error) {
+	defer userdata.lock()()
+	defer userdata.trace("ApproveRecovery", username)(&err)
+	c := userdata.client
+	data, ok := c.ds.Get(request)
+	if !ok || !bytes.Equal(userlib.Hash(data)[:16], request[:]) {
+		return fmt.Errorf("%w: Recovery request missing or altered", ErrIntegrity)
+	}
+
+	var req recoveryRequest
+	err = json.Unmarshal(data, &req)
+	if err != nil {
+		return wrapErr(ErrIntegrity, err)
+	}
+	if req.Username != username {
+		return fmt.Errorf("%w: Recovery request is for %s", ErrIntegrity, req.Username)
+	}
+
+	u, err := recoveryUUID(username, "/"+userdata.Username)
+	if err != nil {
+		return err
+	}
+
+	sealed, ok := c.ds.Get(u)
+	if !ok {
+		return ErrNoRecovery
+	}
+
+	wrap, payload, err := userdata.unseal(sealed)
+	if err != nil {
+		return wrapErr(ErrIntegrity, err)
+	}
+
+	err = userdata.checkContact(username)
+	if err != nil {
+		return err
+	}
+
+	vKey, err := c.verifyKey(username, wrap.Signer)
+	if err != nil {
+		return err
+	}
+
+	err = userlib.DSVerify(vKey, wrap.Encrypted, wrap.Authenticator)
+	if err != nil {
+		return wrapErr(ErrIntegrity, err)
+	}
+
+	var share recoveryShare
+	err = json.Unmarshal(payload, &share)
+	if err != nil || share.Owner != username {
+		return fmt.Errorf("%w: Malformed recovery share", ErrIntegrity)
+	}
+
+	enc, err := userlib.PKEEnc(req.Key, share.Share)
+	if err != nil {
+		return wrapErr(ErrCrypto, err)
+	}
+
+	signed, err := userdata.sign(enc)
+	if err != nil {
+		return err
+	}
+
+	approval, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+
+	u, err = approvalUUID(request, userdata.Username)
+	if err != nil {
+		return err
+	}
+
+	err = c.ds.Set(u, approval)
+	if err != nil {
+		return wrapErr(ErrStorage, err)
+	}
+	return nil
+}
+
+// Complete wraps the account's master key under newPassword once enough
+// trustees have approved, and logs in with it. A keyfile the account had is
+// no longer needed.
+func (recovery *Recovery) Complete(newPassword string) (userdataptr *User, err error) {
+	c := recovery.client
+	defer c.trace("CompleteRecovery", recovery.username, recovery.username)(&err)
+	config, err := c.loadRecoveryConfig(recovery.username)
+	if err != nil {
+		return nil, err
+	}
+
+	var shares [][]byte
+	var used []uuid.UUID
+	for _, trustee := range config.Trustees {
+		u, err := approvalUUID(recovery.ID, trustee)
+		if err != nil {
+			return nil, err
+		}
+
+		share, err := c.loadApproval(u, trustee, recovery.key)
+		if err != nil {
+			continue
+		}
+		shares = append(shares, share)
+		used = append(used, u)
+		if len(shares) == config.Threshold {
+			break
+		}
+	}
+
+	if len(shares) < config.Threshold {
+		return nil, fmt.Errorf("%w: %d of %d approvals", ErrRecoveryIncomplete, len(shares), config.Threshold)
+	}
+
+	recoveryKey, err := combine(shares)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := recoveryUUID(recovery.username, " key")
+	if err != nil {
+		return nil, err
+	}
+
+	// Like logging in, recovery opens the account's entries before it knows
+	// the layout. The master key is checked against the user record.
+	c.legacy = true
+	master, err := c.decryptGetData(u, kindRecoveryKey, recoveryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The master key must open the user record before it replaces the old one
+	u, err = userRecordUUID(recovery.username)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.decryptGetData(u, kindUser, master)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.storeKeyRecord(recovery.username, master, newPassword, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range append(used, recovery.ID) {
+		err = c.ds.Delete(u)
+		if err != nil {
+			return nil, wrapErr(ErrStorage, err)
+		}
+	}
+	return c.GetUser(recovery.username, newPassword)
+}
+
+// Loads and decrypts trustee's approval stored at u
+func (c *Client) loadApproval(u uuid.UUID, trustee string, key userlib.PKEDecKey) ([]byte, error) {
+	bytes, ok := c.ds.Get(u)
+	if !ok {
+		return nil, fmt.Errorf("%w: No approval from %s", ErrRecoveryIncomplete, trustee)
+	}
+
+	var wrap Data
+	err := json.Unmarshal(bytes, &wrap)
+	if err != nil {
+		return nil, wrapErr(ErrIntegrity, err)
+	}
+
+	vKey, err := c.verifyKey(trustee, wrap.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = userlib.DSVerify(vKey, wrap.Encrypted, wrap.Authenticator)
+	if err != nil {
+		return nil, wrapErr(ErrIntegrity, err)
+	}
+
+	share, err := userlib.PKEDec(key, wrap.Encrypted)
+	if err != nil {
+		return nil, wrapErr(ErrIntegrity, err)
+	}
+	return share, nil
+}
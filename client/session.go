@@ -0,0 +1,310 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// One mutex per account, shared by every session of the account made by the
+// same Client
+type accountLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (a *accountLocks) get(username string) *sync.Mutex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l, ok := a.locks[username]
+	if !ok {
+		l = &sync.Mutex{}
+		a.locks[username] = l
+	}
+	return l
+}
+
+func userRecordUUID(username string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(userlib.Hash([]byte(username)))[:16])
+}
+
+// Takes the account lock for a call on the user. Calls on the account made
+// through the same Client take turns, whether they come from several
+// sessions of the account or from goroutines sharing one. The lock is taken
+// before the call is traced and is not reentrant, so calls made on behalf of
+// another call use unexported variants that run under its lock. Sessions on
+// other devices are not locked out; records they change while a call is
+// updating them are caught when the call swaps in its own version.
+func (userdata *User) lock() (unlock func()) {
+	l := userdata.client.accounts.get(userdata.Username)
+	l.Lock()
+	return l.Unlock
+}
+
+// The revision record holds the revision of the user record. It is small,
+// so sessions can check it before every call instead of reloading the
+// record. Accounts created before layoutFreshness have a bare revision, and
+// accounts whose record was never rewritten before then have none. Records
+// from before layoutFileFreshness also hold the sequence number of the shared
+// freshness record, which is no longer read.
+type revisionRecord struct {
+	Revision int
+}
+
+func revisionUUID(username string) (uuid.UUID, error) {
+	return uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("revision")...))[:16])
+}
+
+func decodeRevision(data []byte) (rec revisionRecord, err error) {
+	err = json.Unmarshal(data, &rec)
+	if err != nil {
+		err = json.Unmarshal(data, &rec.Revision)
+	}
+	if err != nil {
+		return rec, wrapErr(ErrIntegrity, err)
+	}
+	return rec, nil
+}
+
+// Reads the revision record, which only accounts created under an older
+// layout may lack
+func (userdata *User) loadRevision() (rec revisionRecord, err error) {
+	u, err := revisionUUID(userdata.Username)
+	if err != nil {
+		return rec, err
+	}
+
+	data, _, err := userdata.client.readEntry(u, kindRevision, userdata.PersonalKey)
+	if err != nil {
+		return rec, err
+	} else if data == nil && userdata.Layout >= layoutFreshness {
+		return rec, fmt.Errorf("%w: Revision record unavailable", ErrIntegrity)
+	} else if data == nil {
+		return rec, nil
+	}
+	return decodeRevision(data)
+}
+
+// Brings the session up to date with the user record, which other sessions
+// may have rewritten, before a call that modifies the account. A revision
+// lower than the session's means a rollback.
+func (userdata *User) refresh() error {
+	c := userdata.client
+	rec, err := userdata.loadRevision()
+	if err != nil {
+		return err
+	}
+
+	if rec.Revision < userdata.Revision {
+		return fmt.Errorf("%w: User record", ErrRollback)
+	}
+	if rec.Revision == userdata.Revision {
+		return nil
+	}
+
+	u, err := userRecordUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.decryptGetData(u, kindUser, userdata.PersonalKey)
+	if err != nil {
+		return err
+	}
+
+	var record User
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return wrapErr(ErrIntegrity, err)
+	}
+
+	// storeUser raises the revision before it writes the record
+	if record.Revision < rec.Revision && record.Revision >= userdata.Revision {
+		return ErrConcurrentModification
+	}
+
+	if record.Username != userdata.Username || record.PersonalUUID != userdata.PersonalUUID ||
+		record.Revision != rec.Revision {
+		return fmt.Errorf("%w: User record does not match the session", ErrIntegrity)
+	}
+
+	// Calls read Username and client before taking the lock, so only the
+	// fields a rewrite can change are copied
+	userdata.PersonalKey, userdata.DecryptionKey, userdata.SignatureKey = record.PersonalKey, record.DecryptionKey, record.SignatureKey
+	userdata.Revision, userdata.KeyVersion, userdata.RetiredKeys = record.Revision, record.KeyVersion, record.RetiredKeys
+	userdata.Layout = record.Layout
+	return nil
+}
+
+// Rewrites the user record under a new revision, so that other sessions
+// reload it before their next call. The revision is raised first, so of two
+// sessions rewriting the record at once only one gets to write it.
+func (userdata *User) storeUser() error {
+	c := userdata.client
+	u, err := revisionUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+
+	err = c.modify(u, kindRevision, userdata.PersonalKey, func(data []byte) ([]byte, error) {
+		var rec revisionRecord
+		if data != nil {
+			rec, err = decodeRevision(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if rec.Revision != userdata.Revision {
+			return nil, ErrConcurrentModification
+		}
+		rec.Revision += 1
+		return json.Marshal(rec)
+	})
+	if err != nil {
+		return err
+	}
+	userdata.Revision += 1
+
+	u, err = userRecordUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	return c.storeInDS(u, kindUser, userdata, userdata.PersonalKey)
+}
+
+// How often a call reads a record again and reapplies its change after
+// another session rewrote the record first
+const maxAttempts = 8
+
+// Reads the record of kind at u, returning its contents along with the
+// entry as stored, for swapInDS. Both are nil if there is no record.
+func (c *Client) readEntry(u uuid.UUID, kind string, key []byte) (data []byte, raw []byte, err error) {
+	raw, ok := c.ds.Get(u)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	var wrap Data
+	err = json.Unmarshal(raw, &wrap)
+	if err != nil {
+		return nil, nil, wrapErr(ErrIntegrity, err)
+	}
+	return c.openEntry(u, kind, key, wrap, raw)
+}
+
+// Applies change to the record of kind at u. change gets the record's
+// contents, or nil if there is none, and returns new contents, or nil to
+// leave the record as it is. If another session rewrites the record first,
+// change is applied again to what that session wrote.
+func (c *Client) modify(u uuid.UUID, kind string, key []byte, change func(data []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		data, raw, err := c.readEntry(u, kind, key)
+		if err != nil {
+			return err
+		}
+
+		data, err = change(data)
+		if err != nil || data == nil {
+			return err
+		}
+
+		_, err = c.swapEpoch(u, kind, data, key, 0, raw)
+		if !errors.Is(err, ErrConcurrentModification) {
+			return err
+		}
+	}
+	return ErrConcurrentModification
+}
+
+// The records an account is given when it is created, by the layout that
+// introduced them. Accounts created under an older layout are given the
+// missing records when they log in; for the others, a missing record is an
+// integrity failure.
+const (
+	layoutNamespace     = 1 // the namespace
+	layoutFreshness     = 2 // the revision record, and the shared freshness record layoutFileFreshness replaced
+	layoutContacts      = 3 // the contact list
+	layoutEnvelope      = 4 // no record, but entries re-sealed with a header, see resealAccount
+	layoutFileFreshness = 5 // no record, but the shared freshness record split up, see splitFreshness
+	currentLayout       = layoutFileFreshness
+)
+
+// Creates the records introduced after layout from, leaving any that another
+// session has already created
+func (userdata *User) createRecords(from int) error {
+	type record struct {
+		layout int
+		uuid   func(string) (uuid.UUID, error)
+		kind   string
+		value  interface{}
+	}
+	records := []record{
+		{layoutNamespace, namespaceUUID, kindNamespace, []string{}},
+		{layoutFreshness, revisionUUID, kindRevision, revisionRecord{Revision: userdata.Revision}},
+		{layoutContacts, contactsUUID, kindContacts, map[string]contact{}},
+	}
+
+	for _, r := range records {
+		if r.layout <= from {
+			continue
+		}
+
+		u, err := r.uuid(userdata.Username)
+		if err != nil {
+			return err
+		}
+		err = userdata.client.swapInDS(u, r.kind, r.value, userdata.PersonalKey, nil)
+		if err != nil && !errors.Is(err, ErrConcurrentModification) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Brings an account created under an older layout up to the current one. The
+// names of files stored before the namespace existed are unknown, so those
+// files are left out of it. Accounts from before layoutFileFreshness have
+// their freshness record split, and accounts from before layoutEnvelope their
+// entries re-sealed, before the layout is raised.
+func (userdata *User) upgradeLayout() error {
+	defer userdata.lock()()
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		err := userdata.refresh()
+		if err != nil {
+			return err
+		} else if userdata.Layout >= currentLayout {
+			return nil
+		}
+
+		err = userdata.createRecords(userdata.Layout)
+		if err != nil {
+			return err
+		}
+
+		if userdata.Layout < layoutFileFreshness {
+			err = userdata.splitFreshness()
+			if err != nil {
+				return err
+			}
+		}
+
+		if userdata.Layout < layoutEnvelope {
+			err = userdata.resealAccount()
+			if err != nil {
+				return err
+			}
+		}
+
+		userdata.Layout = currentLayout
+		err = userdata.storeUser()
+		if !errors.Is(err, ErrConcurrentModification) {
+			return err
+		}
+	}
+	return ErrConcurrentModification
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Shamir secret sharing over GF(2^8), one polynomial per byte of the secret.
+// A share is its x coordinate followed by the polynomials evaluated there.
+
+// Multiplies in GF(2^8) modulo the AES polynomial
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// a^254, the inverse of a nonzero a
+func gfInv(a byte) byte {
+	r := byte(1)
+	for i := 0; i < 254; i += 1 {
+		r = gfMul(r, a)
+	}
+	return r
+}
+
+// Splits secret into n shares, any k of which recover it
+func split(secret []byte, n int, k int) [][]byte {
+	coeffs := make([][]byte, len(secret))
+	for i, b := range secret {
+		coeffs[i] = append([]byte{b}, userlib.RandomBytes(k-1)...)
+	}
+
+	shares := make([][]byte, n)
+	for s := range shares {
+		x := byte(s + 1)
+		share := []byte{x}
+		for _, poly := range coeffs {
+			var y byte
+			for j := len(poly) - 1; j >= 0; j -= 1 {
+				y = gfMul(y, x) ^ poly[j]
+			}
+			share = append(share, y)
+		}
+		shares[s] = share
+	}
+	return shares
+}
+
+// Recovers the secret by interpolating the shares at x = 0
+func combine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("%w: No shares", ErrIntegrity)
+	}
+
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != len(shares[0]) || len(share) < 2 || share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("%w: Malformed share", ErrIntegrity)
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, len(shares[0])-1)
+	for j, share := range shares {
+		// Lagrange basis polynomial of share j at 0
+		basis := byte(1)
+		for m, other := range shares {
+			if m != j {
+				basis = gfMul(basis, gfMul(other[0], gfInv(other[0]^share[0])))
+			}
+		}
+
+		for i := range secret {
+			secret[i] ^= gfMul(share[i+1], basis)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A Tracer observes a Client's API calls and store operations. Events only
+// carry names, locations and sizes, never keys or plaintext. Tracers may be
+// called from several goroutines at once.
+type Tracer interface {
+	Call(ev CallEvent)
+	Store(ev StoreEvent)
+}
+
+// A CallEvent describes a finished API call. Name is the file or user the
+// call was about, and Err is the error it returned.
+type CallEvent struct {
+	Op       string
+	User     string
+	Name     string
+	Duration time.Duration
+	Usage    Usage
+	Err      error
+}
+
+// A StoreEvent describes a single datastore or keystore operation. Datastore
+// operations set UUID and keystore operations set Name. Bytes is the size of
+// the entry read or written, and Found is false for a Get that missed or a
+// CompareAndSwap that found the entry changed.
+type StoreEvent struct {
+	Op       string
+	UUID     uuid.UUID
+	Name     string
+	Bytes    int
+	Found    bool
+	Duration time.Duration
+	Err      error
+}
+
+// NopTracer discards every event.
+type NopTracer struct{}
+
+func (NopTracer) Call(CallEvent)   {}
+func (NopTracer) Store(StoreEvent) {}
+
+// StructuredLogger is the subset of *slog.Logger used by NewLogTracer.
+type StructuredLogger interface {
+	Info(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NewLogTracer returns a Tracer writing every event to l as key-value pairs.
+// Failed operations are logged at error level.
+func NewLogTracer(l StructuredLogger) Tracer {
+	return logTracer{l}
+}
+
+type logTracer struct {
+	l StructuredLogger
+}
+
+func (t logTracer) Call(ev CallEvent) {
+	t.log("call", ev.Err, "op", ev.Op, "user", ev.User, "name", ev.Name, "duration", ev.Duration,
+		"read", ev.Usage.BytesRead, "written", ev.Usage.BytesWritten, "round_trips", ev.Usage.RoundTrips)
+}
+
+func (t logTracer) Store(ev StoreEvent) {
+	args := []interface{}{"op", ev.Op}
+	if ev.Name != "" {
+		args = append(args, "name", ev.Name)
+	} else {
+		args = append(args, "uuid", ev.UUID.String())
+	}
+	t.log("store", ev.Err, append(args, "bytes", ev.Bytes, "found", ev.Found, "duration", ev.Duration)...)
+}
+
+func (t logTracer) log(msg string, err error, args ...interface{}) {
+	if err != nil {
+		t.l.Error(msg, append(args, "err", err.Error())...)
+	} else {
+		t.l.Info(msg, args...)
+	}
+}
+
+// Starts tracing an API call. The returned function finishes it, wrapping
+// the call's error in an OpError first.
+func (c *Client) trace(op string, user string, name string) func(err *error) {
+	start := c.now()
+	snapshot := c.meter.begin()
+	return func(err *error) {
+		usage, exceeded, failed := c.meter.end(snapshot)
+		if exceeded {
+			*err = ErrBudgetExceeded
+		} else if failed != nil {
+			*err = wrapErr(ErrStorage, failed)
+		}
+		setOp(op, name, err)
+		c.tracer.Call(CallEvent{op, user, name, c.now().Sub(start), usage, *err})
+	}
+}
+
+func (user User) trace(op string, name string) func(err *error) {
+	return user.client.trace(op, user.Username, name)
+}
+
+// Reports every operation on ds to the client's tracer
+type tracedDatastore struct {
+	ds Datastore
+	c  *Client
+}
+
+func (t tracedDatastore) Get(u uuid.UUID) ([]byte, bool) {
+	value, ok, _ := t.Lookup(u)
+	return value, ok
+}
+
+func (t tracedDatastore) Lookup(u uuid.UUID) ([]byte, bool, error) {
+	start := t.c.now()
+	value, ok, err := lookup(t.ds, u)
+	t.c.tracer.Store(StoreEvent{"DatastoreGet", u, "", len(value), ok, t.c.now().Sub(start), err})
+	return value, ok, err
+}
+
+func (t tracedDatastore) Set(u uuid.UUID, value []byte) error {
+	start := t.c.now()
+	err := t.ds.Set(u, value)
+	t.c.tracer.Store(StoreEvent{"DatastoreSet", u, "", len(value), true, t.c.now().Sub(start), err})
+	return err
+}
+
+func (t tracedDatastore) Delete(u uuid.UUID) error {
+	start := t.c.now()
+	err := t.ds.Delete(u)
+	t.c.tracer.Store(StoreEvent{"DatastoreDelete", u, "", 0, true, t.c.now().Sub(start), err})
+	return err
+}
+
+func (t tracedDatastore) CompareAndSwap(u uuid.UUID, old []byte, value []byte) (bool, error) {
+	start := t.c.now()
+	swapped, err := compareAndSwap(t.ds, u, old, value)
+	t.c.tracer.Store(StoreEvent{"DatastoreCompareAndSwap", u, "", len(value), swapped, t.c.now().Sub(start), err})
+	return swapped, err
+}
+
+type tracedKeystore struct {
+	ks Keystore
+	c  *Client
+}
+
+func (t tracedKeystore) Get(name string) (userlib.PublicKeyType, bool) {
+	start := t.c.now()
+	value, ok := t.ks.Get(name)
+	t.c.tracer.Store(StoreEvent{"KeystoreGet", uuid.Nil, name, 0, ok, t.c.now().Sub(start), nil})
+	return value, ok
+}
+
+func (t tracedKeystore) Set(name string, value userlib.PublicKeyType) error {
+	start := t.c.now()
+	err := t.ks.Set(name, value)
+	t.c.tracer.Store(StoreEvent{"KeystoreSet", uuid.Nil, name, 0, true, t.c.now().Sub(start), err})
+	return err
+}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Outcome of checking a single datastore entry
+type Status int
+
+const (
+	StatusOK Status = iota
+	StatusMissing
+	StatusUnauthenticated
+	StatusInconsistent
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusMissing:
+		return "missing"
+	case StatusUnauthenticated:
+		return "unauthenticated"
+	case StatusInconsistent:
+		return "inconsistent"
+	}
+	return "ok"
+}
+
+// Roles of the entries walked by Verify
+const (
+	RoleUserRecord = "user record"
+	RoleKeySeed    = "key seed"
+	RoleNamespace  = "namespace"
+	RoleFileMeta   = "file meta"
+	RoleFile       = "file struct"
+	RoleHead       = "chain head"
+	RoleBlock      = "chain block"
+	RoleSuccessor  = "successor node"
+)
+
+// A VerifyEntry is one datastore entry checked by Verify. Name is the file
+// or recipient the entry belongs to, and Detail explains a bad Status.
+type VerifyEntry struct {
+	UUID   uuid.UUID
+	Role   string
+	Name   string
+	Status Status
+	Detail string
+}
+
+type VerifyReport struct {
+	Entries []VerifyEntry
+
+	ds Datastore // the store being walked
+}
+
+// Problems returns the entries that did not check out.
+func (r VerifyReport) Problems() (problems []VerifyEntry) {
+	for _, e := range r.Entries {
+		if e.Status != StatusOK {
+			problems = append(problems, e)
+		}
+	}
+	return problems
+}
+
+func (r VerifyReport) OK() bool {
+	return len(r.Problems()) == 0
+}
+
+func (r *VerifyReport) add(u uuid.UUID, role string, name string, status Status, detail string) {
+	r.Entries = append(r.Entries, VerifyEntry{u, role, name, status, detail})
+}
+
+// Fetches and authenticates the entry at u, a record of kind, recording it
+// unless it fails. The entry is left for the caller to record once its
+// contents are checked.
+func (r *VerifyReport) open(u uuid.UUID, kind string, role string, name string, keys [][]byte, floor int) (data []byte, ok bool) {
+	raw, present := r.ds.Get(u)
+	if !present {
+		r.add(u, role, name, StatusMissing, "")
+		return nil, false
+	}
+
+	var wrap Data
+	err := json.Unmarshal(raw, &wrap)
+	if err != nil {
+		r.add(u, role, name, StatusUnauthenticated, err.Error())
+		return nil, false
+	}
+
+	if wrap.Epoch < floor || wrap.Epoch >= len(keys) {
+		r.add(u, role, name, StatusInconsistent, "sealed under unexpected epoch")
+		return nil, false
+	}
+
+	data, err = wrap.open(u, kind, keys[wrap.Epoch], false)
+	if err != nil {
+		r.add(u, role, name, StatusUnauthenticated, err.Error())
+		return nil, false
+	}
+	return data, true
+}
+
+// Like open, also decoding the entry into v
+func (r *VerifyReport) decode(u uuid.UUID, kind string, role string, name string, key []byte, v interface{}) bool {
+	data, ok := r.open(u, kind, role, name, [][]byte{key}, 0)
+	if !ok {
+		return false
+	}
+
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		r.add(u, role, name, StatusInconsistent, err.Error())
+		return false
+	}
+	return true
+}
+
+// Verify walks every entry reachable from the user's account and checks that
+// it is present, authentic and consistent with the entries pointing to it.
+// Problems are reported in the returned report rather than as errors.
+func (userdata *User) Verify() (report VerifyReport, err error) {
+	defer userdata.lock()()
+	defer userdata.trace("Verify", userdata.Username)(&err)
+	report.ds = userdata.client.ds
+
+	u, err := uuid.FromBytes(userlib.Hash(userlib.Hash([]byte(userdata.Username)))[:16])
+	if err != nil {
+		return report, err
+	}
+
+	var record User
+	if report.decode(u, kindUser, RoleUserRecord, userdata.Username, userdata.PersonalKey, &record) {
+		if record.Username != userdata.Username || record.PersonalUUID != userdata.PersonalUUID {
+			report.add(u, RoleUserRecord, userdata.Username, StatusInconsistent, "does not match the session")
+		} else {
+			report.add(u, RoleUserRecord, userdata.Username, StatusOK, "")
+		}
+	}
+
+	seed, ok := report.open(userdata.PersonalUUID, kindSeed, RoleKeySeed, userdata.Username, [][]byte{userdata.PersonalKey}, 0)
+	if ok && len(seed) != 64 {
+		report.add(userdata.PersonalUUID, RoleKeySeed, userdata.Username, StatusInconsistent, "wrong length")
+	} else if ok {
+		report.add(userdata.PersonalUUID, RoleKeySeed, userdata.Username, StatusOK, "")
+	}
+
+	u, err = namespaceUUID(userdata.Username)
+	if err != nil {
+		return report, err
+	}
+
+	var names []string
+	if !report.decode(u, kindNamespace, RoleNamespace, userdata.Username, userdata.PersonalKey, &names) {
+		return report, nil
+	}
+	report.add(u, RoleNamespace, userdata.Username, StatusOK, "")
+
+	for _, filename := range names {
+		err = userdata.verifyFile(&report, filename)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func (userdata *User) verifyFile(report *VerifyReport, filename string) error {
+	u, err := userdata.getFileMetaUUID(filename)
+	if err != nil {
+		return err
+	}
+
+	var fileInfo FileMeta
+	if !report.decode(u, kindFileMeta, RoleFileMeta, filename, userdata.PersonalKey, &fileInfo) {
+		return nil
+	}
+	if fileInfo.IsSuccessor && len(fileInfo.Successors) > 0 {
+		report.add(u, RoleFileMeta, filename, StatusInconsistent, "recipient lists successors")
+		return nil
+	}
+	report.add(u, RoleFileMeta, filename, StatusOK, "")
+
+	var file File
+	if !report.decode(fileInfo.UUID, kindFile, RoleFile, filename, fileInfo.Key, &file) {
+		return nil
+	}
+	file.adoptLegacyKey()
+	if file.Revoked {
+		report.add(fileInfo.UUID, RoleFile, filename, StatusOK, "access revoked")
+		return nil
+	}
+	if len(file.Keys) == 0 || len(file.Start) < 16 {
+		report.add(fileInfo.UUID, RoleFile, filename, StatusInconsistent, "malformed")
+		return nil
+	}
+	report.add(fileInfo.UUID, RoleFile, filename, StatusOK, "")
+
+	err = verifyChain(report, file, filename)
+	if err != nil {
+		return err
+	}
+
+	for rec, childInfo := range fileInfo.Successors {
+		var child File
+		if !report.decode(childInfo.UUID, kindFile, RoleSuccessor, rec, childInfo.Key, &child) {
+			continue
+		}
+		child.adoptLegacyKey()
+
+		if child.Revoked || !bytes.Equal(child.Start, file.Start) || len(child.Keys) != len(file.Keys) ||
+			!bytes.Equal(child.Keys[file.epoch()], file.Keys[file.epoch()]) {
+			report.add(childInfo.UUID, RoleSuccessor, rec, StatusInconsistent, "does not match the owner's file struct")
+		} else {
+			report.add(childInfo.UUID, RoleSuccessor, rec, StatusOK, "")
+		}
+	}
+	return nil
+}
+
+func verifyChain(report *VerifyReport, file File, filename string) error {
+	headUUID, err := idToUUID(file.Start)
+	if err != nil {
+		return err
+	}
+
+	data, ok := report.open(headUUID, kindHead, RoleHead, filename, file.Keys, file.epoch())
+	if !ok {
+		return nil
+	}
+
+	head, err := decodeHead(report.ds, file, data)
+	if err != nil {
+		report.add(headUUID, RoleHead, filename, StatusInconsistent, err.Error())
+		return nil
+	}
+
+	id := head.first(file)
+	for i := 0; i < head.Count; i += 1 {
+		u, err := idToUUID(id)
+		if err != nil {
+			return err
+		}
+
+		_, ok = report.open(u, kindBlock, RoleBlock, filename, file.Keys, head.floor(i))
+		if ok {
+			report.add(u, RoleBlock, filename, StatusOK, "")
+		}
+		id = userlib.Hash(id)
+	}
+
+	if !bytes.Equal(id, head.End) {
+		report.add(headUUID, RoleHead, filename, StatusInconsistent, "end does not follow the last block")
+	} else {
+		report.add(headUUID, RoleHead, filename, StatusOK, "")
+	}
+	return nil
+}
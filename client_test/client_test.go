@@ -3,10 +3,20 @@ package client_test
 import (
 	// Some imports use an underscore to prevent the compiler from complaining
 	// about unused imports.
+	"encoding/base64"
+	"encoding/binary"
 	_ "encoding/hex"
-	_ "errors"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	_ "strconv"
-	_ "strings"
+	"strings"
+	"sync"
 	"testing"
 
 	// A "dot" import is used here so that the functions in the ginko and gomega
@@ -16,8 +26,13 @@ import (
 	. "github.com/onsi/gomega"
 
 	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
 
 	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/davgate"
+	"github.com/cs161-staff/project2-starter-code/dirsync"
+	"github.com/cs161-staff/project2-starter-code/fsclient"
+	"github.com/cs161-staff/project2-starter-code/localstore"
 )
 
 func TestSetupAndExecution(t *testing.T) {
@@ -42,6 +57,43 @@ const password3 = "passwordthree"
 const password4 = "passwordfour"
 const password5 = "passwordfive"
 
+// Records the events reported to a client.Tracer
+type recorder struct {
+	calls  []client.CallEvent
+	stores []client.StoreEvent
+}
+
+func (r *recorder) Call(ev client.CallEvent)   { r.calls = append(r.calls, ev) }
+func (r *recorder) Store(ev client.StoreEvent) { r.stores = append(r.stores, ev) }
+
+// Formats the lines a client.StructuredLogger is given
+type structuredLog struct {
+	lines  []string
+	errors int
+}
+
+func (l *structuredLog) Info(msg string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintln(append([]interface{}{msg}, args...)...))
+}
+
+func (l *structuredLog) Error(msg string, args ...interface{}) {
+	l.errors += 1
+	l.Info(msg, args...)
+}
+
+// A keystore that can be made to lie about some entries
+type lyingKeystore struct {
+	*client.MemoryKeystore
+	lies map[string]userlib.PublicKeyType
+}
+
+func (k lyingKeystore) Get(name string) (userlib.PublicKeyType, bool) {
+	if value, ok := k.lies[name]; ok {
+		return value, true
+	}
+	return k.MemoryKeystore.Get(name)
+}
+
 
 
 
@@ -728,6 +780,3161 @@ var _ = Describe("Client Tests", func() {
 
 
 
+	Describe("Invitation inbox", func() {
+		BeforeEach(func() {
+			userlib.DebugMsg("Initializing users.")
+			alice, err = client.InitUser("alice", password1)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", password2)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", password3)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Inbox is empty for a new user.", func() {
+			invites, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(BeEmpty())
+		})
+
+		Specify("Recipient finds and accepts invitations from the inbox.", func() {
+			userlib.DebugMsg("Alice and Charles share files with Bob.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = charles.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			inviteC, err := charles.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob lists his inbox.")
+			invites, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(Equal([]client.Invitation{
+				{Sender: "alice", Filename: aliceFile, Pointer: invite},
+				{Sender: "charles", Filename: charlesFile, Pointer: inviteC},
+			}))
+
+			userlib.DebugMsg("Bob accepts the first invitation from his inbox.")
+			err = bob.AcceptInvitation(invites[0].Sender, invites[0].Pointer, invites[0].Filename)
+			Expect(err).To(BeNil())
+
+			data, err := bob.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Accepted invitations leave the inbox.")
+			invites, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(HaveLen(1))
+			Expect(invites[0].Sender).To(Equal("charles"))
+
+			userlib.DebugMsg("Other users' inboxes are unaffected.")
+			invites, err = alice.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(BeEmpty())
+		})
+
+		Specify("Errors when an inbox entry is tampered with.", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID]bool)
+			for k := range userlib.DatastoreGetMap() {
+				before[k] = true
+			}
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Tampering with every new entry except the invitation.")
+			for k, v := range userlib.DatastoreGetMap() {
+				if !before[k] && k != invite {
+					v[len(v)/2] ^= 0xff
+				}
+			}
+
+			invites, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(HaveLen(1))
+			Expect(errors.Is(invites[0].Err, client.ErrInvalidInvitation)).To(BeTrue())
+
+			userlib.DebugMsg("Later invitations are still listed.")
+			err = charles.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			inviteC, err := charles.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			invites, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(HaveLen(2))
+			Expect(invites[1]).To(Equal(client.Invitation{Sender: "charles", Filename: charlesFile, Pointer: inviteC}))
+		})
+
+		Specify("Slots of accepted invitations are reused.", func() {
+			slot := func(i int) userlib.UUID {
+				u, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("bob")), []byte(fmt.Sprintf("inbox/%d", i))...))[:16])
+				Expect(err).To(BeNil())
+				return u
+			}
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Listing frees the slot of the accepted invitation.")
+			invites, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(BeEmpty())
+
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, ok := userlib.DatastoreGet(slot(1))
+			Expect(ok).To(BeFalse())
+			invites, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(Equal([]client.Invitation{{Sender: "alice", Filename: aliceFile, Pointer: invite}}))
+		})
+	})
+
+	Describe("Batch invitations", func() {
+		BeforeEach(func() {
+			userlib.DebugMsg("Initializing users.")
+			alice, err = client.InitUser("alice", password1)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", password2)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", password3)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Share a file with several users at once.", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice inviting Bob, Charles and non-existent Frank.")
+			results, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles", "frank"})
+			Expect(err).To(BeNil())
+			Expect(results).To(HaveLen(3))
+			Expect(results["bob"].Err).To(BeNil())
+			Expect(results["charles"].Err).To(BeNil())
+			Expect(results["frank"].Err).ToNot(BeNil())
+
+			err = bob.AcceptInvitation("alice", results["bob"].Pointer, bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", results["charles"].Pointer, charlesFile)
+			Expect(err).To(BeNil())
+
+			err = charles.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Both recipients are tracked as successors.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Batch invitation writes the owner's file meta once.", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Recording which entries change during the batch.")
+			before := make(map[userlib.UUID][]byte)
+			for k, v := range userlib.DatastoreGetMap() {
+				before[k] = append([]byte{}, v...)
+			}
+
+			results, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			Expect(results).To(HaveLen(2))
+
+			changed := 0
+			for k, v := range userlib.DatastoreGetMap() {
+				if old, ok := before[k]; ok && string(old) != string(v) {
+					changed += 1
+				}
+			}
+			// The KeyGen seed, the file meta and the contact list, which pins
+			// both recipients, are the only records rewritten
+			Expect(changed).To(Equal(3))
+		})
+
+		Specify("Errors when batch sharing a non-existent file.", func() {
+			_, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Recipients whose invitation fails are not made successors.", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = charles.DeleteAccount(password3)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("A failed invitation leaves nothing behind.")
+			entries := len(userlib.DatastoreGetMap())
+			_, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(errors.Is(err, client.ErrUserDeleted)).To(BeTrue())
+			Expect(userlib.DatastoreGetMap()).To(HaveLen(entries))
+
+			results, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			Expect(results["bob"].Err).To(BeNil())
+			Expect(errors.Is(results["charles"].Err, client.ErrUserDeleted)).To(BeTrue())
+
+			userlib.DebugMsg("Only Bob is left to revoke.")
+			notShared, err := alice.RevokeAccessMany(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			Expect(notShared).To(Equal([]string{"charles"}))
+		})
+	})
+
+	Describe("Epoch-based revocation", func() {
+		BeforeEach(func() {
+			userlib.DebugMsg("Initializing users.")
+			alice, err = client.InitUser("alice", password1)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", password2)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", password3)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares a file with Bob and Charles.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			results, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", results["bob"].Pointer, bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", results["charles"].Pointer, charlesFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Revocation cost does not depend on file size.", func() {
+			big := make([]byte, 1<<20)
+			err = alice.StoreFile(aliceFile, big)
+			Expect(err).To(BeNil())
+
+			userlib.DatastoreResetBandwidth()
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", 1<<14))
+		})
+
+		Specify("Remaining users keep reading and writing across epochs.", func() {
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Charles appends in the new epoch before anything is re-sealed.")
+			err = charles.AppendToFile(charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Blocks sealed under a retired epoch are rejected once re-sealed.", func() {
+			snapshot := func() map[userlib.UUID]string {
+				ret := make(map[userlib.UUID]string)
+				for k, v := range userlib.DatastoreGetMap() {
+					ret[k] = string(v)
+				}
+				return ret
+			}
+
+			beforeRevoke := snapshot()
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			afterRevoke := snapshot()
+
+			userlib.DebugMsg("Loading re-seals the old blocks under the new epoch.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Replaying the old-epoch copy of every re-sealed block.")
+			replayed := 0
+			for k, v := range snapshot() {
+				old := beforeRevoke[k]
+				if old == afterRevoke[k] && old != v {
+					userlib.DatastoreSet(k, []byte(old))
+					replayed += 1
+				}
+			}
+			Expect(replayed).To(Equal(1))
+
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Revoking several recipients at once", func() {
+		BeforeEach(func() {
+			userlib.DebugMsg("Initializing users.")
+			alice, err = client.InitUser("alice", password1)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", password2)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", password3)
+			Expect(err).To(BeNil())
+			_, err = client.InitUser("doris", password4)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Revoke two recipients and report the ones never shared with.", func() {
+			results, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", results["bob"].Pointer, bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", results["charles"].Pointer, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DatastoreResetBandwidth()
+			notShared, err := alice.RevokeAccessMany(aliceFile, []string{"bob", "doris", "charles", "frank"})
+			Expect(err).To(BeNil())
+			Expect(notShared).To(Equal([]string{"doris", "frank"}))
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", 1<<14))
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Revoking the same users again reports them as not shared.")
+			notShared, err = alice.RevokeAccessMany(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			Expect(notShared).To(Equal([]string{"bob", "charles"}))
+		})
+
+		Specify("Remaining recipients keep access.", func() {
+			results, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", results["bob"].Pointer, bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", results["charles"].Pointer, charlesFile)
+			Expect(err).To(BeNil())
+
+			notShared, err := alice.RevokeAccessMany(aliceFile, []string{"bob"})
+			Expect(err).To(BeNil())
+			Expect(notShared).To(BeEmpty())
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Recipients listed twice are revoked and reported once.", func() {
+			results, err := alice.CreateInvitations(aliceFile, []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", results["bob"].Pointer, bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", results["charles"].Pointer, charlesFile)
+			Expect(err).To(BeNil())
+
+			notShared, err := alice.RevokeAccessMany(aliceFile, []string{"bob", "frank", "bob", "frank"})
+			Expect(err).To(BeNil())
+			Expect(notShared).To(Equal([]string{"frank"}))
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Errors when revoking on a non-existent file.", func() {
+			_, err := alice.RevokeAccessMany(xFile, []string{"bob"})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Access status", func() {
+		BeforeEach(func() {
+			userlib.DebugMsg("Initializing users.")
+			alice, err = client.InitUser("alice", password1)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", password2)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", password3)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares with Bob, who shares with Charles.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Owners, recipients and unknown files.", func() {
+			status, err := alice.AccessStatus(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(status).To(Equal(client.AccessOwner))
+
+			status, err = charles.AccessStatus(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(status).To(Equal(client.AccessShared))
+
+			status, err = charles.AccessStatus(xFile)
+			Expect(err).To(BeNil())
+			Expect(status).To(Equal(client.AccessNone))
+
+			_, err = charles.LoadFile(xFile)
+			Expect(errors.Is(err, client.ErrFileNotFound)).To(BeTrue())
+		})
+
+		Specify("Revoked subtree sees the revocation.", func() {
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			status, err := bob.AccessStatus(bobFile)
+			Expect(err).To(BeNil())
+			Expect(status).To(Equal(client.AccessRevoked))
+			status, err = charles.AccessStatus(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(status).To(Equal(client.AccessRevoked))
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrAccessRevoked)).To(BeTrue())
+			err = charles.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(errors.Is(err, client.ErrAccessRevoked)).To(BeTrue())
+		})
+
+		Specify("Pending invitations of revoked users cannot be accepted.", func() {
+			err = alice.StoreFile(xFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(xFile, "charles")
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(xFile, "charles")
+			Expect(err).To(BeNil())
+
+			err = charles.AcceptInvitation("alice", invite, xFile)
+			Expect(errors.Is(err, client.ErrAccessRevoked)).To(BeTrue())
+
+			userlib.DebugMsg("The rejected invitation left no file behind.")
+			status, err := charles.AccessStatus(xFile)
+			Expect(err).To(BeNil())
+			Expect(status).To(Equal(client.AccessNone))
+		})
+
+		Specify("Tampering is reported as an integrity failure, not a revocation.", func() {
+			userlib.DebugMsg("Corrupting every datastore entry.")
+			for _, v := range userlib.DatastoreGetMap() {
+				v[len(v)/2] ^= 0xff
+			}
+
+			_, err = charles.AccessStatus(charlesFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			Expect(errors.Is(err, client.ErrAccessRevoked)).To(BeFalse())
+		})
+	})
+
+	Describe("Error kinds", func() {
+		BeforeEach(func() {
+			userlib.DebugMsg("Initializing users.")
+			alice, err = client.InitUser("alice", password1)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", password2)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("User errors.", func() {
+			_, err = client.InitUser("", password1)
+			Expect(errors.Is(err, client.ErrInvalidUsername)).To(BeTrue())
+			_, err = client.InitUser("alice", password2)
+			Expect(errors.Is(err, client.ErrNameTaken)).To(BeTrue())
+			_, err = client.GetUser("frank", password1)
+			Expect(errors.Is(err, client.ErrUserNotFound)).To(BeTrue())
+			_, err = client.GetUser("alice", password2)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+		})
+
+		Specify("File and sharing errors.", func() {
+			_, err = alice.LoadFile(xFile)
+			Expect(errors.Is(err, client.ErrFileNotFound)).To(BeTrue())
+			err = alice.AppendToFile(xFile, []byte(contentTwo))
+			Expect(errors.Is(err, client.ErrFileNotFound)).To(BeTrue())
+			_, err = alice.CreateInvitation(aliceFile, "frank")
+			Expect(errors.Is(err, client.ErrUserNotFound)).To(BeTrue())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(errors.Is(err, client.ErrNotShared)).To(BeTrue())
+
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(errors.Is(err, client.ErrNameTaken)).To(BeTrue())
+
+			userlib.DebugMsg("Invitation checked against the wrong sender.")
+			err = bob.AcceptInvitation("bob", invite, aliceFile)
+			Expect(errors.Is(err, client.ErrInvalidInvitation)).To(BeTrue())
+
+			userlib.DatastoreDelete(invite)
+			err = bob.AcceptInvitation("alice", invite, aliceFile)
+			Expect(errors.Is(err, client.ErrInvalidInvitation)).To(BeTrue())
+		})
+
+		Specify("Integrity errors.", func() {
+			for _, v := range userlib.DatastoreGetMap() {
+				v[len(v)/2] ^= 0xff
+			}
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+
+		Specify("Errors name the failed call.", func() {
+			_, err = alice.LoadFile(xFile)
+			var opErr *client.OpError
+			Expect(errors.As(err, &opErr)).To(BeTrue())
+			Expect(opErr.Op).To(Equal("LoadFile"))
+			Expect(opErr.Name).To(Equal(xFile))
+
+			userlib.DebugMsg("Nested calls are reported under the outer call.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(errors.As(err, &opErr)).To(BeTrue())
+			Expect(opErr.Op).To(Equal("RevokeAccess"))
+
+			results, err := alice.CreateInvitations(aliceFile, []string{"frank"})
+			Expect(err).To(BeNil())
+			Expect(errors.As(results["frank"].Err, &opErr)).To(BeTrue())
+			Expect(opErr.Name).To(Equal("frank"))
+			Expect(errors.Is(results["frank"].Err, client.ErrUserNotFound)).To(BeTrue())
+		})
+	})
+
+	Describe("Account verification", func() {
+		BeforeEach(func() {
+			userlib.DebugMsg("Initializing users.")
+			alice, err = client.InitUser("alice", password1)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", password2)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		roles := func(report client.VerifyReport) map[string]int {
+			ret := make(map[string]int)
+			for _, e := range report.Entries {
+				ret[e.Role] += 1
+			}
+			return ret
+		}
+
+		Specify("An untouched account verifies cleanly.", func() {
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+			Expect(roles(report)).To(Equal(map[string]int{
+				client.RoleUserRecord: 1,
+				client.RoleKeySeed:    1,
+				client.RoleNamespace:  1,
+				client.RoleFileMeta:   1,
+				client.RoleFile:       1,
+				client.RoleHead:       1,
+				client.RoleBlock:      2,
+				client.RoleSuccessor:  1,
+			}))
+
+			report, err = bob.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+			Expect(roles(report)[client.RoleBlock]).To(Equal(2))
+		})
+
+		Specify("Missing and tampered entries are reported.", func() {
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+
+			var block, seed userlib.UUID
+			for _, e := range report.Entries {
+				if e.Role == client.RoleBlock {
+					block = e.UUID
+				} else if e.Role == client.RoleKeySeed {
+					seed = e.UUID
+				}
+			}
+
+			userlib.DebugMsg("Deleting a block and corrupting the key seed.")
+			userlib.DatastoreDelete(block)
+			userlib.DatastoreSet(seed, []byte(contentThree))
+
+			report, err = alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeFalse())
+
+			problems := report.Problems()
+			Expect(problems).To(HaveLen(2))
+			Expect(problems[0].UUID).To(Equal(seed))
+			Expect(problems[0].Status).To(Equal(client.StatusUnauthenticated))
+			Expect(problems[1].UUID).To(Equal(block))
+			Expect(problems[1].Role).To(Equal(client.RoleBlock))
+			Expect(problems[1].Name).To(Equal(aliceFile))
+			Expect(problems[1].Status).To(Equal(client.StatusMissing))
+		})
+
+		Specify("A stale successor node is inconsistent.", func() {
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+
+			var node userlib.UUID
+			for _, e := range report.Entries {
+				if e.Role == client.RoleSuccessor {
+					node = e.UUID
+				}
+			}
+			stale := append([]byte{}, userlib.DatastoreGetMap()[node]...)
+
+			userlib.DebugMsg("Replaying Bob's node from before a key rotation.")
+			charles, err = client.InitUser("charles", password3)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(node, stale)
+
+			report, err = alice.Verify()
+			Expect(err).To(BeNil())
+			problems := report.Problems()
+			Expect(problems).To(HaveLen(1))
+			Expect(problems[0].Role).To(Equal(client.RoleSuccessor))
+			Expect(problems[0].Name).To(Equal("bob"))
+			Expect(problems[0].Status).To(Equal(client.StatusInconsistent))
+		})
+	})
+
+	Describe("Client handles", func() {
+
+		var first, second *client.Client
+
+		BeforeEach(func() {
+			first, err = client.NewClient(client.Options{
+				Datastore: client.NewMemoryDatastore(),
+				Keystore:  client.NewMemoryKeystore(),
+			})
+			Expect(err).To(BeNil())
+
+			second, err = client.NewClient(client.Options{
+				Datastore:      client.NewMemoryDatastore(),
+				Keystore:       client.NewMemoryKeystore(),
+				PasswordKeyLen: 32,
+			})
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Clients with separate stores are isolated.", func() {
+			userlib.DebugMsg("Initializing Alice under both clients.")
+			alice, err = first.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = second.InitUser("alice", password1)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Each Alice only exists in her own client.")
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrUserNotFound)).To(BeTrue())
+			_, err = first.GetUser("alice", password1)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+			Expect(userlib.DatastoreGetMap()).To(BeEmpty())
+
+			userlib.DebugMsg("Storing a file under the first client.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			_, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrFileNotFound)).To(BeTrue())
+
+			alicePhone, err = first.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Sharing stays within a client.", func() {
+			alice, err = first.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = first.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = second.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice cannot invite Charles, who lives in another client.")
+			_, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(errors.Is(err, client.ErrUserNotFound)).To(BeTrue())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Password keys shorter than 32 bytes are rejected.", func() {
+			_, err = client.NewClient(client.Options{PasswordKeyLen: 16})
+			Expect(errors.Is(err, client.ErrInvalidArgument)).To(BeTrue())
+		})
+	})
+
+	Describe("Operation tracing", func() {
+
+		var traced *client.Client
+		var events *recorder
+
+		BeforeEach(func() {
+			events = &recorder{}
+			traced, err = client.NewClient(client.Options{
+				Datastore: client.NewMemoryDatastore(),
+				Keystore:  client.NewMemoryKeystore(),
+				Tracer:    events,
+			})
+			Expect(err).To(BeNil())
+		})
+
+		Specify("API calls and store operations are reported.", func() {
+			alice, err = traced.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(events.calls).To(HaveLen(1))
+			Expect(events.calls[0].Op).To(Equal("InitUser"))
+
+			userlib.DebugMsg("Storing a file while tracing.")
+			events.calls, events.stores = nil, nil
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			last := events.calls[len(events.calls)-1]
+			Expect(last.Op).To(Equal("StoreFile"))
+			Expect(last.User).To(Equal("alice"))
+			Expect(last.Name).To(Equal(aliceFile))
+			Expect(last.Err).To(BeNil())
+			Expect(last.Usage).To(Equal(alice.LastUsage()))
+
+			written := 0
+			for _, ev := range events.stores {
+				if ev.Op == "DatastoreSet" {
+					written += ev.Bytes
+				}
+			}
+			Expect(written).To(BeNumerically(">", len(contentOne)))
+
+			userlib.DebugMsg("Failed calls carry their error.")
+			_, err = alice.LoadFile(bobFile)
+			last = events.calls[len(events.calls)-1]
+			Expect(last.Op).To(Equal("LoadFile"))
+			Expect(last.Err).To(Equal(err))
+		})
+
+		Specify("The log adapter never logs plaintext or keys.", func() {
+			logger := &structuredLog{}
+			traced, err = client.NewClient(client.Options{
+				Datastore: client.NewMemoryDatastore(),
+				Keystore:  client.NewMemoryKeystore(),
+				Tracer:    client.NewLogTracer(logger),
+			})
+			Expect(err).To(BeNil())
+
+			alice, err = traced.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			Expect(logger.errors).To(Equal(1))
+			Expect(logger.lines).To(ContainElement(ContainSubstring("op StoreFile")))
+			for _, line := range logger.lines {
+				Expect(line).ToNot(ContainSubstring(contentOne))
+				Expect(line).ToNot(ContainSubstring(defaultPassword))
+				Expect(line).ToNot(ContainSubstring(string(alice.PersonalKey)))
+			}
+		})
+	})
+
+	Describe("Bandwidth accounting", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Appending only pays for the appended content.", func() {
+			big := make([]byte, 1<<15)
+			err = alice.StoreFile(aliceFile, big)
+			Expect(err).To(BeNil())
+			stored := alice.LastUsage()
+			Expect(stored.BytesWritten).To(BeNumerically(">", len(big)))
+
+			userlib.DebugMsg("Appending a few bytes to a large file.")
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			appended := alice.LastUsage()
+			Expect(appended.BytesRead).To(BeNumerically("<", 1<<12))
+			Expect(appended.BytesWritten).To(BeNumerically("<", 1<<12))
+			Expect(appended.RoundTrips).To(BeNumerically(">", 0))
+
+			userlib.DebugMsg("The usage matches what the datastore saw.")
+			userlib.DatastoreResetBandwidth()
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(alice.LastUsage().BytesRead).To(BeNumerically(">", len(big)))
+			Expect(alice.LastUsage().BytesRead + alice.LastUsage().BytesWritten).To(Equal(userlib.DatastoreGetBandwidth()))
+
+			userlib.DebugMsg("Appending costs the same for an account with many files.")
+			for i := 0; i < 200; i++ {
+				err = alice.StoreFile(fmt.Sprintf("file%d", i), []byte(contentOne))
+				Expect(err).To(BeNil())
+				_, err = alice.LoadFile(fmt.Sprintf("file%d", i))
+				Expect(err).To(BeNil())
+			}
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			Expect(alice.LastUsage().BytesRead).To(BeNumerically("<", 1<<12))
+			Expect(alice.LastUsage().BytesWritten).To(BeNumerically("<", 1<<12))
+		})
+
+		Specify("Calls over budget are stopped.", func() {
+			err = alice.StoreFile(aliceFile, make([]byte, 1<<15))
+			Expect(err).To(BeNil())
+
+			alice.SetBudget(client.Usage{BytesRead: 1 << 12})
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrBudgetExceeded)).To(BeTrue())
+
+			userlib.DebugMsg("Small calls still fit the budget.")
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			alice.SetBudget(client.Usage{BytesWritten: 1 << 12})
+			err = alice.StoreFile(bobFile, make([]byte, 1<<13))
+			Expect(errors.Is(err, client.ErrBudgetExceeded)).To(BeTrue())
+
+			alice.SetBudget(client.Usage{})
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(HaveLen(1<<15 + len(contentOne)))
+		})
+
+		Specify("Overwrites over budget leave the file as it was.", func() {
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			original := userlib.RandomBytes(5000)
+			err = alice.StoreFile(aliceFile, original)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			alice.SetBudget(client.Usage{BytesWritten: 1000})
+			err = alice.StoreFile(aliceFile, userlib.RandomBytes(5000))
+			Expect(errors.Is(err, client.ErrBudgetExceeded)).To(BeTrue())
+			err = alice.AppendToFile(aliceFile, userlib.RandomBytes(5000))
+			Expect(errors.Is(err, client.ErrBudgetExceeded)).To(BeTrue())
+
+			alice.SetBudget(client.Usage{})
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(original))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(original))
+		})
+
+		Specify("Calls stopped at any point leave files whole.", func() {
+			content := []byte(contentOne)
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Stopping overwrites and appends after every number of round trips.")
+			for trips := 1; trips <= 40; trips += 1 {
+				next := []byte(fmt.Sprintf("<%d>", trips))
+				alice.SetBudget(client.Usage{RoundTrips: trips})
+				if trips%2 == 0 {
+					err = alice.StoreFile(aliceFile, next)
+				} else {
+					err = alice.AppendToFile(aliceFile, next)
+					next = append(append([]byte{}, content...), next...)
+				}
+				Expect(err == nil || errors.Is(err, client.ErrBudgetExceeded)).To(BeTrue())
+
+				alice.SetBudget(client.Usage{})
+				data, err := alice.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Or(Equal(content), Equal(next)))
+				content = data
+			}
+		})
+
+		Specify("Revocations stopped at any point are completed by calling again.", func() {
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			content := []byte(contentOne)
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Stopping the revocation of bob after every number of round trips.")
+			finished := false
+			for trips := 1; !finished; trips += 1 {
+				Expect(trips).To(BeNumerically("<", 40))
+				name := fmt.Sprintf("%s%d", bobFile, trips)
+				invite, err := alice.CreateInvitation(aliceFile, "bob")
+				Expect(err).To(BeNil())
+				err = bob.AcceptInvitation("alice", invite, name)
+				Expect(err).To(BeNil())
+
+				alice.SetBudget(client.Usage{RoundTrips: trips})
+				err = alice.RevokeAccess(aliceFile, "bob")
+				alice.SetBudget(client.Usage{})
+				finished = err == nil
+				if !finished {
+					Expect(errors.Is(err, client.ErrBudgetExceeded)).To(BeTrue())
+					err = alice.RevokeAccess(aliceFile, "bob")
+					Expect(err).To(BeNil())
+				}
+
+				data, err := alice.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(content))
+				_, err = bob.LoadFile(name)
+				Expect(errors.Is(err, client.ErrAccessRevoked)).To(BeTrue())
+
+				next := []byte(fmt.Sprintf("<%d>", trips))
+				err = charles.AppendToFile(charlesFile, next)
+				Expect(err).To(BeNil())
+				content = append(content, next...)
+				data, err = alice.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(content))
+			}
+		})
+	})
+
+	Describe("Listing and removing files", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("ListFiles returns owned and shared files.", func() {
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			names, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{aliceFile, charlesFile}))
+
+			names, err = bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{bobFile}))
+		})
+
+		Specify("A recipient removing a file only drops their own access.", func() {
+			err = bob.RemoveFile(bobFile)
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrFileNotFound)).To(BeTrue())
+			names, err := bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(BeEmpty())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Bob can reuse the name.")
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("An owner removing a file deletes it for everyone.", func() {
+			entries := len(userlib.DatastoreGetMap())
+			err = alice.RemoveFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<", entries))
+
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrFileNotFound)).To(BeTrue())
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrAccessRevoked)).To(BeTrue())
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.OK()).To(BeTrue())
+		})
+	})
+
+	Describe("Local persistent store", func() {
+
+		var dir string
+
+		BeforeEach(func() {
+			dir, err = os.MkdirTemp("", "localstore")
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		open := func() *client.Client {
+			opts, err := localstore.Options(dir)
+			Expect(err).To(BeNil())
+			c, err := client.NewClient(opts)
+			Expect(err).To(BeNil())
+			return c
+		}
+
+		Specify("Users and files outlive the client.", func() {
+			alice, err = open().InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Reopening the store.")
+			c := open()
+			_, err = c.InitUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrNameTaken)).To(BeTrue())
+
+			aliceLaptop, err = c.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = aliceLaptop.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Entries that cannot be read are not taken for missing ones.", func() {
+			alice, err = open().InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = open().InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			list := func() map[string]bool {
+				entries, err := os.ReadDir(filepath.Join(dir, "data"))
+				Expect(err).To(BeNil())
+				names := make(map[string]bool)
+				for _, e := range entries {
+					names[e.Name()] = true
+				}
+				return names
+			}
+			before := list()
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			var written []string
+			for name := range list() {
+				if !before[name] {
+					written = append(written, name)
+				}
+			}
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Making the file's entries unreadable.")
+			saved := make(map[string][]byte)
+			for _, name := range written {
+				path := filepath.Join(dir, "data", name)
+				saved[name], err = os.ReadFile(path)
+				Expect(err).To(BeNil())
+				Expect(os.Remove(path)).To(BeNil())
+				Expect(os.Symlink(path, path)).To(BeNil())
+			}
+
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(errors.Is(err, client.ErrStorage)).To(BeTrue())
+
+			userlib.DebugMsg("Once readable again, the file and its share are as they were.")
+			for name, value := range saved {
+				path := filepath.Join(dir, "data", name)
+				Expect(os.Remove(path)).To(BeNil())
+				Expect(os.WriteFile(path, value, 0600)).To(BeNil())
+			}
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+	})
+
+	Describe("Command-line client", func() {
+
+		var dir string
+
+		BeforeEach(func() {
+			dir, err = os.MkdirTemp("", "fsclient")
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		// Runs fsclient as user, giving it the password and then input on stdin
+		run := func(user string, password string, input string, args ...string) (string, error) {
+			var out strings.Builder
+			flags := []string{"-store", dir, "-password-fd", "0"}
+			if user != "" {
+				flags = append(flags, "-user", user)
+			}
+			err := fsclient.Run(append(flags, args...), strings.NewReader(password+"\n"+input), &out)
+			return out.String(), err
+		}
+
+		Specify("Files are stored, shared and revoked.", func() {
+			_, err = run("alice", defaultPassword, "", "init")
+			Expect(err).To(BeNil())
+			_, err = run("bob", defaultPassword, "", "init")
+			Expect(err).To(BeNil())
+
+			_, err = run("alice", defaultPassword, contentOne, "put", aliceFile)
+			Expect(err).To(BeNil())
+			_, err = run("alice", defaultPassword, contentTwo, "append", aliceFile)
+			Expect(err).To(BeNil())
+			out, err := run("alice", defaultPassword, "", "get", aliceFile)
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal(contentOne + contentTwo))
+			out, err = run("alice", defaultPassword, "", "ls")
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal(aliceFile + "\n"))
+
+			userlib.DebugMsg("Alice shares the file with Bob.")
+			out, err = run("alice", defaultPassword, "", "share", aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = run("bob", defaultPassword, "", "accept", "alice", strings.TrimSpace(out), bobFile)
+			Expect(err).To(BeNil())
+			out, err = run("bob", defaultPassword, "", "get", bobFile)
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal(contentOne + contentTwo))
+
+			userlib.DebugMsg("Alice revokes Bob, and a second revocation is reported.")
+			_, err = run("alice", defaultPassword, "", "revoke", aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = run("bob", defaultPassword, "", "get", bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = run("alice", defaultPassword, "", "revoke", aliceFile, "bob")
+			Expect(err).To(MatchError(ContainSubstring("not shared with bob")))
+
+			_, err = run("alice", defaultPassword, "", "rm", aliceFile)
+			Expect(err).To(BeNil())
+			out, err = run("alice", defaultPassword, "", "ls")
+			Expect(err).To(BeNil())
+			Expect(out).To(BeEmpty())
+		})
+
+		Specify("Commands act as the logged in user and check the password.", func() {
+			_, err = run("", defaultPassword, "", "ls")
+			Expect(err).To(MatchError(ContainSubstring("not logged in")))
+
+			_, err = run("alice", defaultPassword, "", "init")
+			Expect(err).To(BeNil())
+			_, err = run("bob", defaultPassword, "", "init")
+			Expect(err).To(BeNil())
+			_, err = run("alice", "wrong", "", "login")
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+			_, err = run("alice", defaultPassword, "", "login")
+			Expect(err).To(BeNil())
+
+			_, err = run("", defaultPassword, contentOne, "put", aliceFile)
+			Expect(err).To(BeNil())
+			out, err := run("alice", defaultPassword, "", "get", aliceFile)
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal(contentOne))
+			_, err = run("", "wrong", "", "get", aliceFile)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+
+			_, err = run("alice", defaultPassword, "", "get")
+			Expect(err).To(MatchError(ContainSubstring("wrong number of arguments")))
+		})
+	})
+
+	Describe("WebDAV gateway", func() {
+
+		var server *httptest.Server
+		var events *recorder
+
+		BeforeEach(func() {
+			events = &recorder{}
+			c, err := client.NewClient(client.Options{
+				Datastore: client.NewMemoryDatastore(),
+				Keystore:  client.NewMemoryKeystore(),
+				Tracer:    events,
+			})
+			Expect(err).To(BeNil())
+			alice, err = c.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = c.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			server = httptest.NewServer(davgate.NewServer(c))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		do := func(method string, path string, password string, body string, header ...string) (int, string) {
+			req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+			Expect(err).To(BeNil())
+			req.SetBasicAuth("bob", password)
+			for i := 0; i < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			Expect(err).To(BeNil())
+			return resp.StatusCode, string(data)
+		}
+
+		Specify("Files can be put, listed, moved and deleted.", func() {
+			status, _ := do("PUT", "/"+bobFile, defaultPassword, contentOne)
+			Expect(status).To(Equal(http.StatusCreated))
+			status, _ = do("PUT", "/"+bobFile, defaultPassword, contentTwo)
+			Expect(status).To(Equal(http.StatusNoContent))
+
+			status, body := do("GET", "/"+bobFile, defaultPassword, "")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(contentTwo))
+
+			status, body = do("PROPFIND", "/", defaultPassword, "", "Depth", "1")
+			Expect(status).To(Equal(http.StatusMultiStatus))
+			Expect(body).To(ContainSubstring("/" + bobFile))
+
+			userlib.DebugMsg("Moving the file.")
+			status, _ = do("MOVE", "/"+bobFile, defaultPassword, "", "Destination", server.URL+"/"+charlesFile)
+			Expect(status).To(Equal(http.StatusCreated))
+			status, _ = do("GET", "/"+bobFile, defaultPassword, "")
+			Expect(status).To(Equal(http.StatusNotFound))
+			data, err := bob.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal(contentTwo))
+
+			status, _ = do("DELETE", "/"+charlesFile, defaultPassword, "")
+			Expect(status).To(Equal(http.StatusNoContent))
+			names, err := bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(BeEmpty())
+		})
+
+		Specify("Errors are reported with their status codes.", func() {
+			status, _ := do("GET", "/"+bobFile, password1, "")
+			Expect(status).To(Equal(http.StatusUnauthorized))
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			status, body := do("GET", "/"+bobFile, defaultPassword, "")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(contentOne))
+
+			userlib.DebugMsg("Revoked files are forbidden.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			status, _ = do("GET", "/"+bobFile, defaultPassword, "")
+			Expect(status).To(Equal(http.StatusForbidden))
+			status, _ = do("PUT", "/"+bobFile, defaultPassword, contentTwo)
+			Expect(status).To(Equal(http.StatusForbidden))
+
+			status, _ = do("PUT", "/"+charlesFile, defaultPassword, contentTwo)
+			Expect(status).To(Equal(http.StatusCreated))
+			status, _ = do("MOVE", "/"+charlesFile, defaultPassword, "", "Destination", "/"+bobFile, "Overwrite", "F")
+			Expect(status).To(Equal(http.StatusPreconditionFailed))
+		})
+
+		Specify("Requests that lost a race with another session can be sent again.", func() {
+			err := fmt.Errorf("%w: head rewritten", client.ErrConcurrentModification)
+			Expect(davgate.Status(err)).To(Equal(http.StatusConflict))
+
+			userlib.DebugMsg("Tampered data is still a server error.")
+			Expect(davgate.Status(client.ErrRollback)).To(Equal(http.StatusInternalServerError))
+			Expect(davgate.Status(client.ErrIntegrity)).To(Equal(http.StatusInternalServerError))
+		})
+
+		Specify("Moving a missing file leaves the destination alone.", func() {
+			status, _ := do("PUT", "/"+charlesFile, defaultPassword, contentOne)
+			Expect(status).To(Equal(http.StatusCreated))
+			status, _ = do("MOVE", "/"+bobFile, defaultPassword, "", "Destination", "/"+charlesFile)
+			Expect(status).To(Equal(http.StatusNotFound))
+
+			status, body := do("GET", "/"+charlesFile, defaultPassword, "")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(contentOne))
+		})
+
+		Specify("Sessions end once the credentials they logged in with change.", func() {
+			status, _ := do("PUT", "/"+bobFile, defaultPassword, contentOne)
+			Expect(status).To(Equal(http.StatusCreated))
+
+			userlib.DebugMsg("Bob changes his password.")
+			err = bob.ChangePassword(defaultPassword, password1)
+			Expect(err).To(BeNil())
+			status, _ = do("GET", "/"+bobFile, defaultPassword, "")
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			status, _ = do("GET", "/"+bobFile, password1, "")
+			Expect(status).To(Equal(http.StatusOK))
+
+			userlib.DebugMsg("Bob enrolls a keyfile, which is sent in a header.")
+			keyfile, err := bob.EnrollKeyfile(password1)
+			Expect(err).To(BeNil())
+			status, _ = do("GET", "/"+bobFile, password1, "")
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			status, body := do("GET", "/"+bobFile, password1, "", davgate.KeyfileHeader, base64.StdEncoding.EncodeToString(keyfile))
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(contentOne))
+
+			userlib.DebugMsg("Bob deletes his account.")
+			err = bob.DeleteAccount(password1)
+			Expect(err).To(BeNil())
+			status, _ = do("GET", "/"+bobFile, password1, "", davgate.KeyfileHeader, base64.StdEncoding.EncodeToString(keyfile))
+			Expect(status).To(Equal(http.StatusUnauthorized))
+		})
+
+		Specify("Listings take sizes from the heads without loading files.", func() {
+			status, _ := do("PUT", "/"+bobFile, defaultPassword, contentOne)
+			Expect(status).To(Equal(http.StatusCreated))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			events.calls = nil
+			status, body := do("PROPFIND", "/", defaultPassword, "", "Depth", "1")
+			Expect(status).To(Equal(http.StatusMultiStatus))
+			Expect(body).To(ContainSubstring(fmt.Sprintf("<D:getcontentlength>%d</D:getcontentlength>", len(contentOne+contentTwo))))
+			for _, call := range events.calls {
+				Expect(call.Op).ToNot(Equal("LoadFile"))
+			}
+		})
+	})
+
+	Describe("Directory sync", func() {
+
+		var laptop, desktop string
+
+		BeforeEach(func() {
+			laptop, err = os.MkdirTemp("", "laptop")
+			Expect(err).To(BeNil())
+			desktop, err = os.MkdirTemp("", "desktop")
+			Expect(err).To(BeNil())
+
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(laptop)
+			os.RemoveAll(desktop)
+		})
+
+		sync := func(user *client.User, dir string) []dirsync.Change {
+			syncer, err := dirsync.New(user, dir)
+			Expect(err).To(BeNil())
+			changes, err := syncer.Sync()
+			Expect(err).To(BeNil())
+			return changes
+		}
+
+		changed := func(name string, action dirsync.Action) []dirsync.Change {
+			return []dirsync.Change{{Name: name, Action: action}}
+		}
+
+		write := func(dir string, name string, content string) {
+			Expect(os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)).To(Succeed())
+		}
+
+		read := func(dir string, name string) string {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			Expect(err).To(BeNil())
+			return string(data)
+		}
+
+		Specify("Changes travel between directories.", func() {
+			write(laptop, aliceFile, contentOne)
+			Expect(sync(aliceLaptop, laptop)).To(Equal(changed(aliceFile, dirsync.Uploaded)))
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile, dirsync.Downloaded)))
+			Expect(read(desktop, aliceFile)).To(Equal(contentOne))
+			Expect(sync(aliceDesktop, desktop)).To(BeEmpty())
+
+			userlib.DebugMsg("A file that only grew is appended to.")
+			write(desktop, aliceFile, contentOne+contentTwo)
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile, dirsync.Appended)))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal(contentOne + contentTwo))
+
+			userlib.DebugMsg("Deletions are mirrored.")
+			sync(aliceLaptop, laptop)
+			Expect(os.Remove(filepath.Join(laptop, aliceFile))).To(Succeed())
+			Expect(sync(aliceLaptop, laptop)).To(Equal(changed(aliceFile, dirsync.DeletedRemote)))
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile, dirsync.DeletedLocal)))
+			_, err = os.Stat(filepath.Join(desktop, aliceFile))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		Specify("Files changed on both sides are kept.", func() {
+			write(laptop, aliceFile, contentOne)
+			sync(aliceLaptop, laptop)
+			sync(aliceDesktop, desktop)
+
+			write(laptop, aliceFile, contentTwo)
+			write(desktop, aliceFile, contentThree)
+			sync(aliceLaptop, laptop)
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile, dirsync.Conflict)))
+			Expect(read(desktop, aliceFile)).To(Equal(contentTwo))
+			Expect(read(desktop, aliceFile+dirsync.ConflictSuffix)).To(Equal(contentThree))
+
+			userlib.DebugMsg("The conflicting copy is uploaded next.")
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile + dirsync.ConflictSuffix, dirsync.Uploaded)))
+		})
+
+		Specify("Copies kept from earlier conflicts are not overwritten.", func() {
+			write(laptop, aliceFile, contentOne)
+			sync(aliceLaptop, laptop)
+			sync(aliceDesktop, desktop)
+
+			write(laptop, aliceFile, contentTwo)
+			write(desktop, aliceFile, contentThree)
+			sync(aliceLaptop, laptop)
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile, dirsync.Conflict)))
+
+			userlib.DebugMsg("A second conflict before the first copy was synced.")
+			write(laptop, aliceFile, contentOne)
+			write(desktop, aliceFile, contentOne+contentThree)
+			sync(aliceLaptop, laptop)
+			Expect(sync(aliceDesktop, desktop)).To(Equal([]dirsync.Change{
+				{Name: aliceFile, Action: dirsync.Conflict},
+				{Name: aliceFile + dirsync.ConflictSuffix, Action: dirsync.Uploaded},
+			}))
+			Expect(read(desktop, aliceFile)).To(Equal(contentOne))
+			Expect(read(desktop, aliceFile+dirsync.ConflictSuffix)).To(Equal(contentThree))
+			Expect(read(desktop, aliceFile+dirsync.ConflictSuffix+".1")).To(Equal(contentOne + contentThree))
+		})
+
+		Specify("Files are only loaded once their head moved on.", func() {
+			events := &recorder{}
+			traced, err := client.NewClient(client.Options{Tracer: events})
+			Expect(err).To(BeNil())
+			aliceDesktop, err = traced.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			loads := func() (n int) {
+				for _, call := range events.calls {
+					if call.Op == "LoadFile" {
+						n += 1
+					}
+				}
+				return n
+			}
+
+			write(laptop, aliceFile, contentOne)
+			sync(aliceLaptop, laptop)
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile, dirsync.Downloaded)))
+			events.calls = nil
+			Expect(sync(aliceDesktop, desktop)).To(BeEmpty())
+			Expect(loads()).To(Equal(0))
+
+			userlib.DebugMsg("A remote append is loaded once.")
+			write(laptop, aliceFile, contentOne+contentTwo)
+			Expect(sync(aliceLaptop, laptop)).To(Equal(changed(aliceFile, dirsync.Appended)))
+			events.calls = nil
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile, dirsync.Downloaded)))
+			Expect(loads()).To(Equal(1))
+			Expect(read(desktop, aliceFile)).To(Equal(contentOne + contentTwo))
+
+			userlib.DebugMsg("The device's own upload is not loaded back.")
+			write(desktop, aliceFile, contentThree)
+			Expect(sync(aliceDesktop, desktop)).To(Equal(changed(aliceFile, dirsync.Uploaded)))
+			events.calls = nil
+			Expect(sync(aliceDesktop, desktop)).To(BeEmpty())
+			Expect(loads()).To(Equal(0))
+		})
+
+		Specify("A tampered state database is rejected.", func() {
+			write(laptop, aliceFile, contentOne)
+			sync(aliceLaptop, laptop)
+
+			path := filepath.Join(laptop, dirsync.StateFile)
+			data, err := os.ReadFile(path)
+			Expect(err).To(BeNil())
+			data[len(data)-1] ^= 1
+			Expect(os.WriteFile(path, data, 0600)).To(Succeed())
+
+			syncer, err := dirsync.New(aliceLaptop, laptop)
+			Expect(err).To(BeNil())
+			_, err = syncer.Sync()
+			Expect(err).To(Equal(dirsync.ErrStateTampered))
+		})
+	})
+
+	Describe("Password changes", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Files survive a password change.", func() {
+			key, err := alice.DeriveKey("test")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Changing Alice's password.")
+			err = alice.ChangePassword(defaultPassword, newPassword)
+			Expect(err).To(BeNil())
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+			aliceLaptop, err = client.GetUser("alice", newPassword)
+			Expect(err).To(BeNil())
+
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			derived, err := aliceLaptop.DeriveKey("test")
+			Expect(err).To(BeNil())
+			Expect(derived).To(Equal(key))
+
+			userlib.DebugMsg("Existing sessions and shares keep working.")
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = aliceLaptop.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrAccessRevoked)).To(BeTrue())
+		})
+
+		Specify("The old password must be given.", func() {
+			err = alice.ChangePassword(password1, newPassword)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+
+			userlib.DebugMsg("A replaced password no longer works.")
+			err = bob.ChangePassword(defaultPassword, newPassword)
+			Expect(err).To(BeNil())
+			err = bob.ChangePassword(defaultPassword, password1)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+	})
+
+	Describe("Concurrent sessions", func() {
+
+		var c *client.Client
+		var ds *client.MemoryDatastore
+		var ks *client.MemoryKeystore
+
+		// Runs f once per session, each in its own goroutine
+		parallel := func(sessions []*client.User, f func(i int, session *client.User)) {
+			var wg sync.WaitGroup
+			for i, session := range sessions {
+				wg.Add(1)
+				go func(i int, session *client.User) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					f(i, session)
+				}(i, session)
+			}
+			wg.Wait()
+		}
+
+		BeforeEach(func() {
+			ds, ks = client.NewMemoryDatastore(), client.NewMemoryKeystore()
+			c, err = client.NewClient(client.Options{
+				Datastore: ds,
+				Keystore:  ks,
+			})
+			Expect(err).To(BeNil())
+
+			_, err = c.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			for _, name := range []string{"bob", "charles", "doris"} {
+				_, err = c.InitUser(name, defaultPassword)
+				Expect(err).To(BeNil())
+			}
+		})
+
+		sessions := func(n int) (users []*client.User) {
+			for i := 0; i < n; i++ {
+				user, err := c.GetUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				users = append(users, user)
+			}
+			return users
+		}
+
+		// Logs alice in on n clients sharing the stores, as on separate devices
+		devices := func(n int) (users []*client.User) {
+			for i := 0; i < n; i++ {
+				device, err := client.NewClient(client.Options{Datastore: ds, Keystore: ks})
+				Expect(err).To(BeNil())
+				user, err := device.GetUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				users = append(users, user)
+			}
+			return users
+		}
+
+		Specify("Invitations sent at once from separate devices all reach the inbox.", func() {
+			var senders []*client.User
+			for _, name := range []string{"alice", "charles", "doris"} {
+				device, err := client.NewClient(client.Options{Datastore: ds, Keystore: ks})
+				Expect(err).To(BeNil())
+				sender, err := device.GetUser(name, defaultPassword)
+				Expect(err).To(BeNil())
+				err = sender.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				senders = append(senders, sender)
+			}
+
+			parallel(senders, func(i int, sender *client.User) {
+				for j := 0; j < 5; j++ {
+					_, err := sender.CreateInvitation(aliceFile, "bob")
+					Expect(err).To(BeNil())
+				}
+			})
+
+			bob, err = c.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			invites, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invites).To(HaveLen(15))
+			for _, invite := range invites {
+				Expect(invite.Err).To(BeNil())
+			}
+		})
+
+		Specify("Appends from separate devices all land once.", func() {
+			users := devices(3)
+			err = users[0].StoreFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+
+			parallel(users, func(i int, session *client.User) {
+				for j := 0; j < 20; j++ {
+					err := session.AppendToFile(aliceFile, []byte(fmt.Sprintf("<%d.%d>", i, j)))
+					Expect(err).To(BeNil())
+				}
+			})
+
+			data, err := users[0].LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			for i := range users {
+				for j := 0; j < 20; j++ {
+					Expect(strings.Count(string(data), fmt.Sprintf("<%d.%d>", i, j))).To(Equal(1))
+				}
+			}
+		})
+
+		Specify("Files stored from separate devices are all listed.", func() {
+			users := devices(3)
+			parallel(users, func(i int, session *client.User) {
+				for j := 0; j < 20; j++ {
+					err := session.StoreFile(fmt.Sprintf("file%d.%d", i, j), []byte(contentOne))
+					Expect(err).To(BeNil())
+				}
+			})
+
+			names, err := users[0].ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(HaveLen(60))
+		})
+
+		Specify("Appends from parallel sessions all land.", func() {
+			users := sessions(4)
+			err = users[0].StoreFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+
+			parallel(users, func(i int, session *client.User) {
+				for j := 0; j < 5; j++ {
+					err := session.AppendToFile(aliceFile, []byte(contentOne))
+					Expect(err).To(BeNil())
+				}
+			})
+
+			data, err := users[0].LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(HaveLen(4 * 5 * len(contentOne)))
+		})
+
+		Specify("Calls on one session shared by goroutines take turns.", func() {
+			alice, err = c.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+
+			shared := []*client.User{alice, alice, alice, alice, alice, alice, alice, alice}
+			parallel(shared, func(i int, session *client.User) {
+				for j := 0; j < 25; j++ {
+					err := session.AppendToFile(aliceFile, []byte(contentOne))
+					Expect(err).To(BeNil())
+					_, err = session.ListFiles()
+					Expect(err).To(BeNil())
+				}
+			})
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(HaveLen(8 * 25 * len(contentOne)))
+		})
+
+		Specify("Files stored from parallel sessions are all listed.", func() {
+			users := sessions(4)
+			parallel(users, func(i int, session *client.User) {
+				err := session.StoreFile(fmt.Sprintf("file%d", i), []byte(contentOne))
+				Expect(err).To(BeNil())
+			})
+
+			names, err := users[0].ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(ConsistOf("file0", "file1", "file2", "file3"))
+		})
+
+		Specify("Parallel sessions derive distinct keys.", func() {
+			users := sessions(4)
+			keys := make([][]byte, len(users))
+			parallel(users, func(i int, session *client.User) {
+				key, err := session.KeyGen()
+				Expect(err).To(BeNil())
+				keys[i] = key
+			})
+
+			for i := range keys {
+				for j := i + 1; j < len(keys); j++ {
+					Expect(keys[i]).ToNot(Equal(keys[j]))
+				}
+			}
+		})
+
+		Specify("Invitations from parallel sessions are all kept.", func() {
+			users := sessions(3)
+			err = users[0].StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			recipients := []string{"bob", "charles", "doris"}
+			invites := make([]uuid.UUID, len(users))
+			parallel(users, func(i int, session *client.User) {
+				invite, err := session.CreateInvitation(aliceFile, recipients[i])
+				Expect(err).To(BeNil())
+				invites[i] = invite
+			})
+
+			for i, name := range recipients {
+				user, err := c.GetUser(name, defaultPassword)
+				Expect(err).To(BeNil())
+				err = user.AcceptInvitation("alice", invites[i], bobFile)
+				Expect(err).To(BeNil())
+				data, err := user.LoadFile(bobFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne)))
+			}
+
+			userlib.DebugMsg("Revoking one recipient leaves the others.")
+			err = users[1].RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			doris, err := c.GetUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = doris.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A tampered revision record stops mutating calls.", func() {
+			alice, err = c.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			u, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("alice")), []byte("revision")...))[:16])
+			Expect(err).To(BeNil())
+			err = ds.Set(u, []byte("garbage"))
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+	})
+
+	Describe("Account recovery", func() {
+
+		var doris *client.User
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetupRecovery([]string{"bob", "charles", "doris"}, 2)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A threshold of trustees can reset the password.", func() {
+			userlib.DebugMsg("Alice forgot her password and asks for recovery.")
+			recovery, err := client.StartRecovery("alice")
+			Expect(err).To(BeNil())
+
+			err = bob.ApproveRecovery("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			_, err = recovery.Complete(newPassword)
+			Expect(errors.Is(err, client.ErrRecoveryIncomplete)).To(BeTrue())
+
+			err = doris.ApproveRecovery("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = recovery.Complete(newPassword)
+			Expect(err).To(BeNil())
+
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+			_, err = client.GetUser("alice", newPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The approvals cannot be used again.")
+			_, err = recovery.Complete(password1)
+			Expect(err).ToNot(BeNil())
+			_, err = client.GetUser("alice", newPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Recovery set up before a key rotation still works.", func() {
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+
+			recovery, err := client.StartRecovery("alice")
+			Expect(err).To(BeNil())
+			err = bob.ApproveRecovery("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			err = doris.ApproveRecovery("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = recovery.Complete(newPassword)
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Only the current trustees hold shares.", func() {
+			_, err = client.StartRecovery("bob")
+			Expect(errors.Is(err, client.ErrNoRecovery)).To(BeTrue())
+
+			err = alice.SetupRecovery([]string{"bob", "charles"}, 2)
+			Expect(err).To(BeNil())
+
+			recovery, err := client.StartRecovery("alice")
+			Expect(err).To(BeNil())
+			err = doris.ApproveRecovery("alice", recovery.ID)
+			Expect(errors.Is(err, client.ErrNoRecovery)).To(BeTrue())
+
+			err = bob.ApproveRecovery("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			err = charles.ApproveRecovery("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			_, err = recovery.Complete(newPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Setups with unusable trustees are rejected.", func() {
+			err = alice.SetupRecovery([]string{"bob", "charles"}, 3)
+			Expect(errors.Is(err, client.ErrInvalidArgument)).To(BeTrue())
+			err = alice.SetupRecovery([]string{"bob", "bob"}, 1)
+			Expect(errors.Is(err, client.ErrInvalidArgument)).To(BeTrue())
+			err = alice.SetupRecovery([]string{"bob", "alice"}, 1)
+			Expect(errors.Is(err, client.ErrInvalidArgument)).To(BeTrue())
+			err = alice.SetupRecovery([]string{"bob", "eve"}, 1)
+			Expect(errors.Is(err, client.ErrUserNotFound)).To(BeTrue())
+		})
+
+		Specify("Trustees refuse altered requests.", func() {
+			recovery, err := client.StartRecovery("alice")
+			Expect(err).To(BeNil())
+
+			err = bob.ApproveRecovery("charles", recovery.ID)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+			userlib.DatastoreSet(recovery.ID, []byte("garbage"))
+			err = bob.ApproveRecovery("alice", recovery.ID)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+	})
+
+	Describe("Key rotation", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Invitations to old and new keys can be accepted.", func() {
+			before, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob rotates his keys from another session.")
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = bobLaptop.RotateKeys()
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			after, err := alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+
+			invitations, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(invitations).To(HaveLen(2))
+
+			err = bob.AcceptInvitation("alice", before, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", after, xFile)
+			Expect(err).To(BeNil())
+
+			data, err := bob.LoadFile(xFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+
+		Specify("Invitations signed with rotated keys verify.", func() {
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Versions published by someone else are ignored.", func() {
+			ek, _, err := userlib.PKEKeyGen()
+			Expect(err).To(BeNil())
+			_, vk, err := userlib.DSKeyGen()
+			Expect(err).To(BeNil())
+			userlib.KeystoreSet("bobe#1", ek)
+			userlib.KeystoreSet("bobv#1", vk)
+
+			userlib.DebugMsg("A first contact needs the keys confirmed while the version is unaccounted for.")
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(errors.Is(err, client.ErrKeyChanged)).To(BeTrue())
+			fingerprint, err := bob.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			err = alice.ConfirmContact("bob", fingerprint)
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob's rotation skips the squatted version.")
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, xFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Signatures made with rotated keys are rejected.", func() {
+			leaked := alice.SignatureKey
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Signing an invitation again with Alice's leaked old key.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			raw, ok := userlib.DatastoreGet(invite)
+			Expect(ok).To(BeTrue())
+			var wrap client.Data
+			err = json.Unmarshal(raw, &wrap)
+			Expect(err).To(BeNil())
+			wrap.Authenticator, err = userlib.DSSign(leaked, wrap.Encrypted)
+			Expect(err).To(BeNil())
+			wrap.Signer = 0
+			forged, err := json.Marshal(wrap)
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(invite, forged)
+
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(errors.Is(err, client.ErrInvalidInvitation)).To(BeTrue())
+
+			userlib.DebugMsg("The invitation as Alice signed it is accepted.")
+			userlib.DatastoreSet(invite, raw)
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A deleted certificate does not make first contacts fall back to older keys.", func() {
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			cert, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("alice")), []byte("key cert/1")...))[:16])
+			Expect(err).To(BeNil())
+			userlib.DatastoreDelete(cert)
+
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = bob.CreateInvitation(bobFile, "alice")
+			Expect(errors.Is(err, client.ErrKeyChanged)).To(BeTrue())
+
+			userlib.DebugMsg("The fallback keys do not match what Alice sees for herself.")
+			fingerprint, err := alice.Fingerprint("alice")
+			Expect(err).To(BeNil())
+			err = bob.ConfirmContact("alice", fingerprint)
+			Expect(errors.Is(err, client.ErrKeyChanged)).To(BeTrue())
+		})
+
+		Specify("A version squatted with only its verification key is skipped.", func() {
+			_, vk, err := userlib.DSKeyGen()
+			Expect(err).To(BeNil())
+			userlib.KeystoreSet("alicev#1", vk)
+
+			fingerprint, err := bob.Fingerprint("alice")
+			Expect(err).To(BeNil())
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob follows Alice's rotation past the squatted version.")
+			rotated, err := bob.Fingerprint("alice")
+			Expect(err).To(BeNil())
+			Expect(rotated).ToNot(Equal(fingerprint))
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+	})
+
+	Describe("Account deletion", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			err = bob.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(charlesFile, "alice")
+			Expect(err).To(BeNil())
+			err = alice.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Deleting an account revokes its shares and retires the name.", func() {
+			err = alice.DeleteAccount(password1)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+
+			err = alice.DeleteAccount(defaultPassword)
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrAccessRevoked)).To(BeTrue())
+			data, err := bob.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrUserDeleted)).To(BeTrue())
+			_, err = client.InitUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrNameTaken)).To(BeTrue())
+
+			_, err = bob.CreateInvitation(charlesFile, "alice")
+			Expect(errors.Is(err, client.ErrUserDeleted)).To(BeTrue())
+		})
+
+		Specify("Recovery, inbox and rotated keys are cleaned up.", func() {
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			err = alice.SetupRecovery([]string{"bob"}, 1)
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(xFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			_, err = bob.CreateInvitation(xFile, "alice")
+			Expect(err).To(BeNil())
+
+			entries := len(userlib.DatastoreGetMap())
+			err = alice.DeleteAccount(defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<", entries))
+
+			_, err = client.StartRecovery("alice")
+			Expect(errors.Is(err, client.ErrNoRecovery)).To(BeTrue())
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrUserDeleted)).To(BeTrue())
+		})
+
+		Specify("Inviting a deleted user leaves no successor, however far the deletion got.", func() {
+			userlib.DebugMsg("Stopping deletions after every number of round trips.")
+			finished := false
+			for trips := 1; !finished; trips += 1 {
+				Expect(trips).To(BeNumerically("<", 100))
+				name := fmt.Sprintf("doris%d", trips)
+				doris, err := client.InitUser(name, defaultPassword)
+				Expect(err).To(BeNil())
+				err = doris.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+
+				doris.SetBudget(client.Usage{RoundTrips: trips})
+				err = doris.DeleteAccount(defaultPassword)
+				doris.SetBudget(client.Usage{})
+				finished = err == nil
+				if !finished {
+					Expect(errors.Is(err, client.ErrBudgetExceeded)).To(BeTrue())
+				}
+
+				// Until the name is retired the account can still be
+				// logged in to and the deletion finished
+				_, err = client.GetUser(name, defaultPassword)
+				if err != nil {
+					Expect(errors.Is(err, client.ErrUserDeleted)).To(BeTrue())
+					_, err = bob.CreateInvitation(charlesFile, name)
+					Expect(errors.Is(err, client.ErrUserDeleted)).To(BeTrue())
+					err = bob.RevokeAccess(charlesFile, name)
+					Expect(errors.Is(err, client.ErrNotShared)).To(BeTrue())
+				}
+			}
+		})
+	})
+
+	Describe("Password KDF parameters", func() {
+
+		var ds *client.MemoryDatastore
+		var ks *client.MemoryKeystore
+
+		withKDF := func(kdf client.KDFParams) *client.Client {
+			c, err := client.NewClient(client.Options{Datastore: ds, Keystore: ks, KDF: kdf})
+			Expect(err).To(BeNil())
+			return c
+		}
+
+		// Reads the public KDF record of username
+		kdfRecord := func(username string) (rec struct {
+			Alg     string
+			Time    uint32
+			Memory  uint32
+			Threads uint8
+			Salt    []byte
+		}) {
+			u, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte(username)), []byte("kdf")...))[:16])
+			Expect(err).To(BeNil())
+			data, ok := ds.Get(u)
+			Expect(ok).To(BeTrue())
+			Expect(json.Unmarshal(data, &rec)).To(BeNil())
+			return rec
+		}
+
+		weak := client.KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+		strong := client.KDFParams{Time: 2, Memory: 16 * 1024, Threads: 2}
+
+		BeforeEach(func() {
+			ds = client.NewMemoryDatastore()
+			ks = client.NewMemoryKeystore()
+		})
+
+		Specify("Accounts with old parameters log in and are upgraded.", func() {
+			alice, err = withKDF(weak).InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			before := kdfRecord("alice")
+			Expect(before.Alg).To(Equal("argon2id"))
+			Expect(before.Memory).To(Equal(weak.Memory))
+
+			userlib.DebugMsg("A client with stronger settings logs Alice in.")
+			aliceLaptop, err = withKDF(strong).GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			after := kdfRecord("alice")
+			Expect(after.Time).To(Equal(strong.Time))
+			Expect(after.Memory).To(Equal(strong.Memory))
+			Expect(after.Salt).ToNot(Equal(before.Salt))
+
+			userlib.DebugMsg("Clients with weaker settings use the stored ones.")
+			_, err = withKDF(weak).GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(kdfRecord("alice")).To(Equal(after))
+			_, err = withKDF(weak).GetUser("alice", password1)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+		})
+
+		Specify("Every account and password gets its own salt.", func() {
+			c := withKDF(weak)
+			alice, err = c.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = c.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			salt := kdfRecord("alice").Salt
+			Expect(salt).ToNot(Equal(kdfRecord("bob").Salt))
+
+			err = alice.ChangePassword(defaultPassword, newPassword)
+			Expect(err).To(BeNil())
+			Expect(kdfRecord("alice").Salt).ToNot(Equal(salt))
+			_, err = c.GetUser("alice", newPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Tampered parameters do not let anyone in.", func() {
+			c := withKDF(weak)
+			_, err = c.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			u, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("alice")), []byte("kdf")...))[:16])
+			Expect(err).To(BeNil())
+			rec := kdfRecord("alice")
+			rec.Salt = userlib.RandomBytes(16)
+			data, err := json.Marshal(rec)
+			Expect(err).To(BeNil())
+			Expect(ds.Set(u, data)).To(BeNil())
+			_, err = c.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+
+			rec.Memory = 1 << 31
+			data, err = json.Marshal(rec)
+			Expect(err).To(BeNil())
+			Expect(ds.Set(u, data)).To(BeNil())
+			_, err = c.GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+
+		Specify("Unusable parameters are rejected.", func() {
+			_, err = client.NewClient(client.Options{KDF: client.KDFParams{Time: 1, Memory: 4, Threads: 1}})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Contact pinning", func() {
+
+		var c *client.Client
+		var ks lyingKeystore
+		var ds *client.MemoryDatastore
+
+		BeforeEach(func() {
+			ks = lyingKeystore{client.NewMemoryKeystore(), make(map[string]userlib.PublicKeyType)}
+			ds = client.NewMemoryDatastore()
+			c, err = client.NewClient(client.Options{Datastore: ds, Keystore: ks})
+			Expect(err).To(BeNil())
+
+			alice, err = c.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = c.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = c.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A missing contact list is not taken as a fresh one.", func() {
+			contacts, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("alice")), []byte("contacts")...))[:16])
+			Expect(err).To(BeNil())
+			err = ds.Delete(contacts)
+			Expect(err).To(BeNil())
+
+			ek, _, err := userlib.PKEKeyGen()
+			Expect(err).To(BeNil())
+			ks.lies["bobe"] = ek
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			_, err = alice.ListInvitations()
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Changed keys are refused until confirmed.", func() {
+			fingerprint, err := alice.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(fingerprint).To(HaveLen(39))
+			other, err := charles.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(other).To(Equal(fingerprint))
+
+			userlib.DebugMsg("The keystore starts handing out another key for Bob.")
+			ek, _, err := userlib.PKEKeyGen()
+			Expect(err).To(BeNil())
+			ks.lies["bobe"] = ek
+
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(errors.Is(err, client.ErrKeyChanged)).To(BeTrue())
+
+			changed, err := alice.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(changed).ToNot(Equal(fingerprint))
+
+			err = alice.ConfirmContact("bob", fingerprint)
+			Expect(errors.Is(err, client.ErrKeyChanged)).To(BeTrue())
+			err = alice.ConfirmContact("bob", strings.ToUpper(changed))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Charles has never contacted Bob and pins the new key.")
+			err = charles.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = charles.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Invitations from senders with changed keys are refused.", func() {
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			_, vk, err := userlib.DSKeyGen()
+			Expect(err).To(BeNil())
+			ks.lies["alicev"] = vk
+
+			err = alice.StoreFile(xFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(xFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, xFile)
+			Expect(errors.Is(err, client.ErrKeyChanged)).To(BeTrue())
+		})
+
+		Specify("Pins follow certified rotations.", func() {
+			fingerprint, err := alice.Fingerprint("bob")
+			Expect(err).To(BeNil())
+
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			rotated, err := alice.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(rotated).ToNot(Equal(fingerprint))
+		})
+	})
+
+	Describe("Keyfile logins", func() {
+
+		Specify("Keyfile accounts need both the password and the keyfile.", func() {
+			alice, keyfile, err := client.InitUserWithKeyfile("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(keyfile).To(HaveLen(32))
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrKeyfileRequired)).To(BeTrue())
+			_, err = client.GetUserWithKeyfile("alice", defaultPassword, userlib.RandomBytes(32))
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+			_, err = client.GetUserWithKeyfile("alice", password1, keyfile)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+
+			aliceLaptop, err = client.GetUserWithKeyfile("alice", defaultPassword, keyfile)
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Changing the password keeps the keyfile.")
+			err = aliceLaptop.ChangePassword(defaultPassword, newPassword)
+			Expect(err).To(BeNil())
+			_, err = client.GetUser("alice", newPassword)
+			Expect(errors.Is(err, client.ErrKeyfileRequired)).To(BeTrue())
+			_, err = client.GetUserWithKeyfile("alice", newPassword, keyfile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Keyfiles can be enrolled and removed.", func() {
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			_, err = bob.EnrollKeyfile(password1)
+			Expect(errors.Is(err, client.ErrInvalidCredentials)).To(BeTrue())
+			keyfile, err := bob.EnrollKeyfile(defaultPassword)
+			Expect(err).To(BeNil())
+
+			_, err = client.GetUser("bob", defaultPassword)
+			Expect(errors.Is(err, client.ErrKeyfileRequired)).To(BeTrue())
+			_, err = client.GetUserWithKeyfile("bob", defaultPassword, keyfile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("A session without the keyfile cannot drop it.")
+			err = bobLaptop.ChangePassword(defaultPassword, newPassword)
+			Expect(errors.Is(err, client.ErrKeyfileRequired)).To(BeTrue())
+			err = bobLaptop.RemoveKeyfile(defaultPassword)
+			Expect(errors.Is(err, client.ErrKeyfileRequired)).To(BeTrue())
+
+			err = bob.RemoveKeyfile(defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = client.GetUserWithKeyfile("bob", defaultPassword, keyfile)
+			Expect(err).To(BeNil())
+		})
+	})
+
+	Describe("Datastore location binding", func() {
+		var entries map[string][]userlib.UUID
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			entries = make(map[string][]userlib.UUID)
+			for _, e := range report.Entries {
+				entries[e.Role+"/"+e.Name] = append(entries[e.Role+"/"+e.Name], e.UUID)
+			}
+		})
+
+		swap := func(a userlib.UUID, b userlib.UUID) {
+			dataA, _ := userlib.DatastoreGet(a)
+			dataB, _ := userlib.DatastoreGet(b)
+			userlib.DatastoreSet(a, dataB)
+			userlib.DatastoreSet(b, dataA)
+		}
+
+		Specify("Swapped file metadata is rejected.", func() {
+			swap(entries[client.RoleFileMeta+"/"+aliceFile][0], entries[client.RoleFileMeta+"/"+bobFile][0])
+
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			_, err = alice.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			Expect(report.Problems()).To(HaveLen(2))
+			Expect(report.Problems()[0].Status).To(Equal(client.StatusUnauthenticated))
+		})
+
+		Specify("Swapped chain blocks are rejected.", func() {
+			blocks := entries[client.RoleBlock+"/"+aliceFile]
+			Expect(blocks).To(HaveLen(2))
+			swap(blocks[0], blocks[1])
+
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+
+		Specify("Entries copied to another location are rejected.", func() {
+			userlib.DebugMsg("Copying one file's metadata over another's.")
+			data, ok := userlib.DatastoreGet(entries[client.RoleFileMeta+"/"+aliceFile][0])
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreSet(entries[client.RoleFileMeta+"/"+bobFile][0], data)
+			_, err = alice.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+			userlib.DebugMsg("Copying the first block over the second.")
+			blocks := entries[client.RoleBlock+"/"+aliceFile]
+			data, ok = userlib.DatastoreGet(blocks[0])
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreSet(blocks[1], data)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+			userlib.DebugMsg("Copying the namespace over the key seed.")
+			data, ok = userlib.DatastoreGet(entries[client.RoleNamespace+"/alice"][0])
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreSet(entries[client.RoleKeySeed+"/alice"][0], data)
+			err = alice.StoreFile(charlesFile, []byte(contentOne))
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+	})
+
+	Describe("Rollback protection", func() {
+		var head userlib.UUID
+
+		// Snapshots the entries of a file's head and blocks
+		snapshot := func(user *client.User, filename string) map[userlib.UUID][]byte {
+			report, err := user.Verify()
+			Expect(err).To(BeNil())
+			entries := make(map[userlib.UUID][]byte)
+			for _, e := range report.Entries {
+				if e.Name == filename && (e.Role == client.RoleHead || e.Role == client.RoleBlock) {
+					data, ok := userlib.DatastoreGet(e.UUID)
+					Expect(ok).To(BeTrue())
+					entries[e.UUID] = data
+					if e.Role == client.RoleHead {
+						head = e.UUID
+					}
+				}
+			}
+			return entries
+		}
+
+		replay := func(entries map[userlib.UUID][]byte) {
+			for u, data := range entries {
+				userlib.DatastoreSet(u, data)
+			}
+		}
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Replaying an old head to hide appends is detected.", func() {
+			stale := snapshot(alice, aliceFile)
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Replaying the head from before the append.")
+			userlib.DatastoreSet(head, stale[head])
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+
+			userlib.DebugMsg("Other sessions of the user detect it too.")
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+		})
+
+		Specify("Restoring the content from before a StoreFile is detected.", func() {
+			stale := snapshot(alice, aliceFile)
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			replay(stale)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+
+			userlib.DebugMsg("Storing the file again recovers it.")
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+		})
+
+		Specify("Recipients detect rollbacks of heads they have seen.", func() {
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			stale := snapshot(alice, aliceFile)
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DatastoreSet(head, stale[head])
+			_, err = bob.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+		})
+
+		Specify("Replaying the file's freshness record along with the head is detected.", func() {
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			stale := snapshot(alice, aliceFile)
+			freshness, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("alice")), []byte("freshness/"+head.String())...))[:16])
+			Expect(err).To(BeNil())
+			staleRecord, ok := userlib.DatastoreGet(freshness)
+			Expect(ok).To(BeTrue())
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Replaying both, to the session that saw the append.")
+			userlib.DatastoreSet(head, stale[head])
+			userlib.DatastoreSet(freshness, staleRecord)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+
+			userlib.DebugMsg("Deleting the freshness record does not reset the session's protection.")
+			userlib.DatastoreDelete(freshness)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+
+			userlib.DebugMsg("Files the session has not seen are unaffected.")
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("A head can be confirmed after a false rollback.", func() {
+			stale := snapshot(alice, aliceFile)
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Restoring the file from a backup.")
+			for u := range snapshot(alice, aliceFile) {
+				if _, ok := stale[u]; !ok {
+					userlib.DatastoreDelete(u)
+				}
+			}
+			replay(stale)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+
+			err = alice.ConfirmFile(aliceFile)
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentThree)))
+		})
+	})
+
+	Describe("Hybrid invitations", func() {
+
+		BeforeEach(func() {
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Invitations are not limited by the public key size.", func() {
+			userlib.DebugMsg("Sharing from a user whose name alone outgrows an RSA block.")
+			longName := strings.Repeat("a", 300)
+			sender, err := client.InitUser(longName, defaultPassword)
+			Expect(err).To(BeNil())
+			err = sender.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			invite, err := sender.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation(longName, invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Invitations re-signed by someone else are rejected.", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			mallory, err := client.InitUser("mallory", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Mallory signs Alice's invitation as her own.")
+			raw, ok := userlib.DatastoreGet(invite)
+			Expect(ok).To(BeTrue())
+			var wrap client.Data
+			err = json.Unmarshal(raw, &wrap)
+			Expect(err).To(BeNil())
+			wrap.Authenticator, err = userlib.DSSign(mallory.SignatureKey, wrap.Encrypted)
+			Expect(err).To(BeNil())
+			raw, err = json.Marshal(wrap)
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(invite, raw)
+
+			err = bob.AcceptInvitation("mallory", invite, bobFile)
+			Expect(errors.Is(err, client.ErrInvalidInvitation)).To(BeTrue())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(errors.Is(err, client.ErrInvalidInvitation)).To(BeTrue())
+		})
+	})
+
+	Describe("Envelope format", func() {
+		var namespace, record userlib.UUID
+
+		envelope := func(u userlib.UUID) (wrap client.Data) {
+			raw, ok := userlib.DatastoreGet(u)
+			Expect(ok).To(BeTrue())
+			err := json.Unmarshal(raw, &wrap)
+			Expect(err).To(BeNil())
+			return wrap
+		}
+
+		setEnvelope := func(u userlib.UUID, wrap client.Data) {
+			raw, err := json.Marshal(wrap)
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(u, raw)
+		}
+
+		// Seals plain at u the way clients did before envelopes had a header:
+		// the MAC covers the ciphertext alone
+		sealLegacy := func(u userlib.UUID, key []byte, plain []byte) {
+			enc := userlib.SymEnc(key[:16], userlib.RandomBytes(16), plain)
+			mac, err := userlib.HMACEval(key[16:32], enc)
+			Expect(err).To(BeNil())
+			setEnvelope(u, client.Data{Encrypted: enc, Authenticator: mac})
+		}
+
+		// Rewrites the entry at u in the format without a header
+		makeLegacy := func(u userlib.UUID, key []byte) {
+			sealLegacy(u, key, userlib.SymDec(key[:16], envelope(u).Encrypted))
+		}
+
+		// Rewrites user's record without a header, with the layout of accounts
+		// from before headers or an older one
+		legacyRecord := func(user *client.User, layout int) {
+			user.Layout = layout
+			data, err := json.Marshal(user)
+			Expect(err).To(BeNil())
+			sealLegacy(record, user.PersonalKey, data)
+		}
+
+		// The bytes the MAC of a record of kind at u covers ahead of the
+		// ciphertext: a fixed tag, then each field prefixed with its length
+		macInput := func(u userlib.UUID, kind string, wrap client.Data) []byte {
+			header := fmt.Sprintf("%d %s %s %d", wrap.Version, wrap.Alg, wrap.KeyID, wrap.Epoch)
+			input := []byte("sealed envelope\x00")
+			for _, field := range [][]byte{u[:], []byte(kind), []byte(header)} {
+				n := make([]byte, 4)
+				binary.BigEndian.PutUint32(n, uint32(len(field)))
+				input = append(append(input, n...), field...)
+			}
+			return input
+		}
+
+		// The entries of alice's file by role, along with the keys they were
+		// sealed under
+		fileEntries := func(filename string) (entries map[string][]userlib.UUID, meta client.FileMeta, keys [][]byte) {
+			report, err := alice.Verify()
+			Expect(err).To(BeNil())
+			entries = make(map[string][]userlib.UUID)
+			for _, e := range report.Entries {
+				if e.Name == filename {
+					entries[e.Role] = append(entries[e.Role], e.UUID)
+				}
+			}
+
+			u := entries[client.RoleFileMeta][0]
+			err = json.Unmarshal(userlib.SymDec(alice.PersonalKey[:16], envelope(u).Encrypted), &meta)
+			Expect(err).To(BeNil())
+			var file struct{ Keys [][]byte }
+			err = json.Unmarshal(userlib.SymDec(meta.Key[:16], envelope(meta.UUID).Encrypted), &file)
+			Expect(err).To(BeNil())
+			return entries, meta, file.Keys
+		}
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			namespace, err = uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("alice")), []byte("namespace")...))[:16])
+			Expect(err).To(BeNil())
+			record, err = uuid.FromBytes(userlib.Hash(userlib.Hash([]byte("alice")))[:16])
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Entries carry a versioned header.", func() {
+			wrap := envelope(namespace)
+			Expect(wrap.Version).To(Equal(2))
+			Expect(wrap.Alg).ToNot(BeEmpty())
+			Expect(wrap.KeyID).ToNot(BeEmpty())
+		})
+
+		Specify("Entries without a header are re-sealed when an account from before them logs in.", func() {
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			entries, meta, keys := fileEntries(aliceFile)
+
+			userlib.DebugMsg("Rewriting alice's account and file without headers.")
+			legacy := []userlib.UUID{namespace, record, entries[client.RoleFileMeta][0], meta.UUID}
+			makeLegacy(namespace, alice.PersonalKey)
+			makeLegacy(entries[client.RoleFileMeta][0], alice.PersonalKey)
+			makeLegacy(meta.UUID, meta.Key)
+			for _, u := range append(entries[client.RoleHead], entries[client.RoleBlock]...) {
+				makeLegacy(u, keys[envelope(u).Epoch])
+				legacy = append(legacy, u)
+			}
+			legacyRecord(alice, 3)
+
+			userlib.DebugMsg("Sessions of accounts that are re-sealed do not open them.")
+			_, err = alice.ListFiles()
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+			userlib.DebugMsg("Logging in re-seals them.")
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			for _, u := range legacy {
+				Expect(envelope(u).Version).To(Equal(2))
+			}
+			Expect(aliceLaptop.Layout).To(BeNumerically(">", 3))
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			names, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{aliceFile}))
+
+			userlib.DebugMsg("They are not opened again once re-sealed.")
+			makeLegacy(namespace, alice.PersonalKey)
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = aliceLaptop.ListFiles()
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			makeLegacy(record, alice.PersonalKey)
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+
+		Specify("The single freshness record of older accounts is split per file when they log in.", func() {
+			entries, _, _ := fileEntries(aliceFile)
+			head := entries[client.RoleHead][0]
+			stale, ok := userlib.DatastoreGet(head)
+			Expect(ok).To(BeTrue())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			stat, err := alice.StatFile(aliceFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Moving the version alice has seen into a record shared by all her files.")
+			fileFreshness, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("alice")), []byte("freshness/"+head.String())...))[:16])
+			Expect(err).To(BeNil())
+			userlib.DatastoreDelete(fileFreshness)
+			shared, err := uuid.FromBytes(userlib.Hash(append(userlib.Hash([]byte("alice")), []byte("freshness")...))[:16])
+			Expect(err).To(BeNil())
+			data, err := json.Marshal(map[string]interface{}{"Seq": 1, "Seen": map[string]int{head.String(): stat.Version}})
+			Expect(err).To(BeNil())
+			sealLegacy(shared, alice.PersonalKey, data)
+			legacyRecord(alice, 3)
+
+			userlib.DebugMsg("Logging in splits it, so the replayed head is still caught.")
+			userlib.DatastoreSet(head, stale)
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, ok = userlib.DatastoreGet(shared)
+			Expect(ok).To(BeFalse())
+			_, ok = userlib.DatastoreGet(fileFreshness)
+			Expect(ok).To(BeTrue())
+			_, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(errors.Is(err, client.ErrRollback)).To(BeTrue())
+		})
+
+		Specify("Entries of the first versioned format are opened and re-sealed on access.", func() {
+			userlib.DebugMsg("Sealing the namespace the way the first versioned clients did.")
+			wrap := envelope(namespace)
+			wrap.Version = 1
+			plain := userlib.SymDec(alice.PersonalKey[:16], wrap.Encrypted)
+			wrap.Encrypted = userlib.SymEnc(alice.PersonalKey[:16], userlib.RandomBytes(16), plain)
+			input := append(namespace[:], []byte("namespace\x00")...)
+			input = append(input, fmt.Sprintf("1 %s %s 0\x00", wrap.Alg, wrap.KeyID)...)
+			wrap.Authenticator, err = userlib.HMACEval(alice.PersonalKey[16:32], append(input, wrap.Encrypted...))
+			Expect(err).To(BeNil())
+			setEnvelope(namespace, wrap)
+
+			names, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{aliceFile}))
+			Expect(envelope(namespace).Version).To(Equal(2))
+		})
+
+		Specify("Files stored before key epochs are loaded, appended to and replaced.", func() {
+			at := func(id []byte) userlib.UUID {
+				u, err := uuid.FromBytes(id[:16])
+				Expect(err).To(BeNil())
+				return u
+			}
+
+			userlib.DebugMsg("Writing a file in the format without epochs.")
+			start, key := userlib.RandomBytes(64), userlib.RandomBytes(32)
+			first := userlib.Hash(start)
+			second := userlib.Hash(first)
+			sealLegacy(at(first), key, []byte(contentOne))
+			sealLegacy(at(second), key, []byte(contentTwo))
+			sealLegacy(at(start), key, userlib.Hash(second))
+
+			file, err := json.Marshal(struct{ Start, Key []byte }{start, key})
+			Expect(err).To(BeNil())
+			meta := client.FileMeta{UUID: uuid.New(), Key: userlib.RandomBytes(32), Successors: map[string]client.FileMeta{}}
+			sealLegacy(meta.UUID, meta.Key, file)
+			metaData, err := json.Marshal(meta)
+			Expect(err).To(BeNil())
+			sealLegacy(at(userlib.Hash(append(userlib.Hash([]byte("alice")), userlib.Hash([]byte(bobFile))...))), alice.PersonalKey, metaData)
+			names, err := json.Marshal([]string{aliceFile, bobFile})
+			Expect(err).To(BeNil())
+			sealLegacy(namespace, alice.PersonalKey, names)
+			legacyRecord(alice, 3)
+
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			stat, err := alice.StatFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(stat.Size).To(Equal(len(contentOne + contentTwo)))
+
+			err = alice.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			stat, err = aliceLaptop.StatFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(stat.Size).To(Equal(len(contentOne + contentTwo + contentThree)))
+
+			err = aliceLaptop.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			stat, err = alice.StatFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(stat.Size).To(Equal(len(contentTwo)))
+
+			userlib.DebugMsg("A file struct without keys is reported, not indexed.")
+			file, err = json.Marshal(struct{ Start []byte }{start})
+			Expect(err).To(BeNil())
+			sealLegacy(meta.UUID, meta.Key, file)
+			legacyRecord(alice, 3)
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(bobFile)
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+
+		Specify("Accounts from before the namespace are given one at login.", func() {
+			userlib.DebugMsg("Writing alice's record the way clients did before the namespace.")
+			userlib.DatastoreDelete(namespace)
+			legacyRecord(alice, 0)
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			names, err := aliceLaptop.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(BeEmpty())
+			err = aliceLaptop.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			names, err = alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{bobFile}))
+
+			userlib.DebugMsg("Files stored before then are still there.")
+			content, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(content).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Accounts that have a namespace must keep it.")
+			userlib.DatastoreDelete(namespace)
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = aliceLaptop.ListFiles()
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+		})
+
+		Specify("Unknown versions and altered headers are rejected.", func() {
+			wrap := envelope(namespace)
+
+			userlib.DebugMsg("An unknown version.")
+			altered := wrap
+			altered.Version = 3
+			setEnvelope(namespace, altered)
+			_, err = alice.ListFiles()
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+			userlib.DebugMsg("An unknown algorithm.")
+			altered = wrap
+			altered.Alg = "rot13"
+			setEnvelope(namespace, altered)
+			_, err = alice.ListFiles()
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+			userlib.DebugMsg("A stripped header.")
+			setEnvelope(namespace, client.Data{Encrypted: wrap.Encrypted, Authenticator: wrap.Authenticator})
+			_, err = alice.ListFiles()
+			Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+			userlib.DebugMsg("The original entry still opens.")
+			setEnvelope(namespace, wrap)
+			_, err = alice.ListFiles()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Blocks rewritten without a header, keeping their MAC.")
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			blocks, _, _ := fileEntries(aliceFile)
+			first, second := blocks[client.RoleBlock][0], blocks[client.RoleBlock][1]
+			original := envelope(first)
+			input := macInput(first, "block", original)
+
+			// Clients without headers MACed the UUID, kind and a zero byte
+			// ahead of the ciphertext, or the ciphertext alone
+			downgrades := [][]byte{
+				append(append([]byte{}, input[len(first)+len("block")+1:]...), original.Encrypted...),
+				append(append([]byte{}, input...), original.Encrypted...),
+			}
+			for _, at := range []userlib.UUID{first, second} {
+				saved := envelope(at)
+				for _, enc := range downgrades {
+					setEnvelope(at, client.Data{Encrypted: enc, Authenticator: original.Authenticator})
+					_, err = alice.LoadFile(aliceFile)
+					Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+
+					aliceLaptop, err = client.GetUser("alice", defaultPassword)
+					Expect(err).To(BeNil())
+					_, err = aliceLaptop.LoadFile(aliceFile)
+					Expect(errors.Is(err, client.ErrIntegrity)).To(BeTrue())
+				}
+				setEnvelope(at, saved)
+			}
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+	})
+
 	Describe("Basic Tests", func() {
 
 		Specify("Basic Test: Testing InitUser/GetUser on a single user.", func() {
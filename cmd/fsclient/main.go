@@ -0,0 +1,47 @@
+// Command fsclient stores and shares end-to-end encrypted files from the
+// command line, keeping the datastore and keystore in a local directory.
+//
+// Usage:
+//
+//	fsclient [-store dir] [-user name] [-password-fd n] [-keyfile file] command [args]
+//
+// The commands are:
+//
+//	init                       create the user and log in as them
+//	login                      check the password and log in
+//	put <name> [file]          store a file, read from stdin by default
+//	get <name> [file]          load a file, written to stdout by default
+//	append <name> [file]       append to a file, read from stdin by default
+//	share <name> <user>        invite a user, printing the invitation
+//	accept <user> <inv> <name> accept an invitation from user under name
+//	revoke <name> <user>...    revoke the access of users
+//	ls                         list the user's files
+//	rm <name>                  remove a file
+//	sync <dir>                 mirror a directory to the user's files
+//
+// sync polls every -interval until interrupted, or makes a single pass with
+// -once. Files changed on both sides are kept locally with a .conflict suffix,
+// numbered if an earlier conflict copy is still there.
+//
+// Logging in only records the username in the store; the password is asked
+// for by every command. It is read from the terminal, or from the first line
+// of the file descriptor given by -password-fd when scripting.
+//
+// With -keyfile, init writes a new keyfile that is needed along with the
+// password to log in, and other commands read it from there.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cs161-staff/project2-starter-code/fsclient"
+)
+
+func main() {
+	err := fsclient.Run(os.Args[1:], os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsclient:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,287 @@
+// Package davgate serves a user's encrypted files over WebDAV, so they can be
+// browsed and edited from ordinary tools. Users authenticate with HTTP basic
+// auth and see their namespace as a single flat directory.
+package davgate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"golang.org/x/net/webdav"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// KeyfileHeader carries the keyfile, base64-encoded, of users whose account
+// needs one along with the password given by basic auth.
+const KeyfileHeader = "X-Keyfile"
+
+// Server is an http.Handler for the users of one client. GET, PUT, DELETE
+// and MOVE are mapped onto the User file operations directly, so that their
+// failures are reported with precise status codes; PROPFIND and the other
+// methods are left to the webdav package.
+type Server struct {
+	c     *client.Client
+	locks webdav.LockSystem
+
+	mu       sync.Mutex
+	sessions map[string]*client.User // by hash of username, password and keyfile
+}
+
+func NewServer(c *client.Client) *Server {
+	return &Server{c: c, locks: webdav.NewMemLS(), sessions: make(map[string]*client.User)}
+}
+
+// Status returns the HTTP status code reporting err.
+func Status(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, client.ErrFileNotFound), errors.Is(err, client.ErrUserNotFound), errors.Is(err, client.ErrUserDeleted):
+		return http.StatusNotFound
+	case errors.Is(err, client.ErrInvalidCredentials), errors.Is(err, client.ErrKeyfileRequired):
+		return http.StatusUnauthorized
+	case errors.Is(err, client.ErrAccessRevoked), errors.Is(err, client.ErrNotShared):
+		return http.StatusForbidden
+	case errors.Is(err, client.ErrNameTaken):
+		return http.StatusConflict
+	case errors.Is(err, client.ErrConcurrentModification):
+		// Another session kept changing the same records; the request can
+		// be sent again
+		return http.StatusConflict
+	case errors.Is(err, client.ErrInvalidUsername), errors.Is(err, client.ErrInvalidInvitation):
+		return http.StatusBadRequest
+	case errors.Is(err, client.ErrBudgetExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, client.ErrStorage):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := s.login(r)
+	if err != nil {
+		if Status(err) == http.StatusNotFound || Status(err) == http.StatusBadRequest {
+			err = client.ErrInvalidCredentials
+		}
+		s.fail(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		name, ok := filename(r.URL.Path)
+		if !ok {
+			break
+		}
+		content, err := user.LoadFile(name)
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(content))
+		return
+
+	case http.MethodPut:
+		s.put(w, r, user)
+		return
+
+	case http.MethodDelete:
+		name, ok := filename(r.URL.Path)
+		if !ok {
+			http.Error(w, "Cannot delete the root", http.StatusForbidden)
+			return
+		}
+		err = user.RemoveFile(name)
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case "MOVE":
+		s.move(w, r, user)
+		return
+	}
+
+	handler := webdav.Handler{FileSystem: fileSystem{user}, LockSystem: s.locks}
+	handler.ServeHTTP(w, r)
+}
+
+// Logs in the user named by the request's basic auth and keyfile header,
+// reusing the session of an earlier request with the same credentials for as
+// long as they still log in
+func (s *Server) login(r *http.Request) (*client.User, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, client.ErrInvalidCredentials
+	}
+
+	var keyfile []byte
+	if header := r.Header.Get(KeyfileHeader); header != "" {
+		var err error
+		keyfile, err = base64.StdEncoding.DecodeString(header)
+		if err != nil {
+			return nil, client.ErrInvalidCredentials
+		}
+	}
+
+	key := string(userlib.Hash(append([]byte(username+"\x00"+password+"\x00"), keyfile...)))
+	s.mu.Lock()
+	user, ok := s.sessions[key]
+	s.mu.Unlock()
+	if ok {
+		current, err := user.LoginCurrent()
+		if err != nil {
+			return nil, err
+		} else if current {
+			return user, nil
+		}
+
+		s.mu.Lock()
+		delete(s.sessions, key)
+		s.mu.Unlock()
+	}
+
+	var err error
+	if keyfile != nil {
+		user, err = s.c.GetUserWithKeyfile(username, password, keyfile)
+	} else {
+		user, err = s.c.GetUser(username, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.sessions[key] = user
+	s.mu.Unlock()
+	return user, nil
+}
+
+func (s *Server) fail(w http.ResponseWriter, err error) {
+	status := Status(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="davgate"`)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, user *client.User) {
+	name, ok := filename(r.URL.Path)
+	if !ok {
+		http.Error(w, "Cannot write the root", http.StatusMethodNotAllowed)
+		return
+	}
+
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	access, err := user.AccessStatus(name)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if access == client.AccessRevoked {
+		s.fail(w, client.ErrAccessRevoked)
+		return
+	}
+
+	err = user.StoreFile(name, content)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	if access == client.AccessNone {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) move(w http.ResponseWriter, r *http.Request, user *client.User) {
+	name, ok := filename(r.URL.Path)
+	if !ok {
+		http.Error(w, "Cannot move the root", http.StatusForbidden)
+		return
+	}
+
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || (dest.Host != "" && dest.Host != r.Host) {
+		http.Error(w, "Invalid destination", http.StatusBadRequest)
+		return
+	}
+	newname, ok := filename(dest.Path)
+	if !ok {
+		http.Error(w, "Invalid destination", http.StatusBadRequest)
+		return
+	}
+	if newname == name {
+		http.Error(w, "Destination equals source", http.StatusForbidden)
+		return
+	}
+
+	// The destination is only removed once the source is known to be there
+	source, err := user.AccessStatus(name)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if source == client.AccessNone {
+		s.fail(w, client.ErrFileNotFound)
+		return
+	} else if source == client.AccessRevoked {
+		s.fail(w, client.ErrAccessRevoked)
+		return
+	}
+
+	access, err := user.AccessStatus(newname)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if access != client.AccessNone {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		err = user.RemoveFile(newname)
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+	}
+
+	err = user.RenameFile(name, newname)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	if access == client.AccessNone {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Returns the filename a request path refers to, and false for the root
+func filename(p string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	return name, name != ""
+}
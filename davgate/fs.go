@@ -0,0 +1,215 @@
+package davgate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// Presents a user's namespace to the webdav package as a flat directory
+type fileSystem struct {
+	user *client.User
+}
+
+// Translates client errors into the os errors the webdav package expects
+func osErr(err error) error {
+	switch Status(err) {
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	case http.StatusForbidden:
+		return os.ErrPermission
+	case http.StatusConflict:
+		return os.ErrExist
+	}
+	return err
+}
+
+func (fs fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, ok := filename(name)
+	if !ok {
+		return &file{reader: bytes.NewReader(nil), fs: fs, info: fileInfo{"/", 0, true}}, nil
+	}
+
+	f := &file{fs: fs, info: fileInfo{name, 0, false}}
+	if flag&os.O_TRUNC != 0 {
+		f.dirty = true
+		f.reader = bytes.NewReader(nil)
+		return f, nil
+	}
+
+	stat, err := fs.user.StatFile(name)
+	if errors.Is(err, client.ErrFileNotFound) && flag&os.O_CREATE != 0 {
+		f.reader = bytes.NewReader(nil)
+		return f, nil
+	} else if err != nil {
+		return nil, osErr(err)
+	}
+	f.info.size = int64(stat.Size)
+	return f, nil
+}
+
+func (fs fileSystem) RemoveAll(ctx context.Context, name string) error {
+	name, ok := filename(name)
+	if !ok {
+		return os.ErrPermission
+	}
+	return osErr(fs.user.RemoveFile(name))
+}
+
+func (fs fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, ok := filename(oldName)
+	newName, ok2 := filename(newName)
+	if !ok || !ok2 {
+		return os.ErrPermission
+	}
+	return osErr(fs.user.RenameFile(oldName, newName))
+}
+
+func (fs fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, ok := filename(name)
+	if !ok {
+		return fileInfo{"/", 0, true}, nil
+	}
+
+	stat, err := fs.user.StatFile(name)
+	if err != nil {
+		return nil, osErr(err)
+	}
+	return fileInfo{name, int64(stat.Size), false}, nil
+}
+
+// An open file, or the root directory. The content is loaded when it is
+// first read or written, since the webdav package opens every file it lists
+// to read its properties. Writes are buffered and stored when the file is
+// closed.
+type file struct {
+	reader *bytes.Reader // nil until the content is loaded
+	fs     fileSystem
+	info   fileInfo
+	buf    []byte
+	dirty  bool
+	listed bool
+}
+
+func (f *file) load() error {
+	if f.reader != nil {
+		return nil
+	}
+
+	content, err := f.fs.user.LoadFile(f.info.name)
+	if err != nil {
+		return osErr(err)
+	}
+	f.buf = content
+	f.reader = bytes.NewReader(content)
+	return nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	err := f.load()
+	if err != nil {
+		return 0, err
+	}
+	return f.reader.Read(p)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	err := f.load()
+	if err != nil {
+		return 0, err
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if f.info.dir {
+		return 0, os.ErrPermission
+	}
+	err := f.load()
+	if err != nil {
+		return 0, err
+	}
+	f.buf = append(f.buf, p...)
+	f.dirty = true
+	return len(p), nil
+}
+
+func (f *file) Close() error {
+	if !f.dirty {
+		return nil
+	}
+	f.dirty = false
+	return osErr(f.fs.user.StoreFile(f.info.name, f.buf))
+}
+
+// Lists the files the user can still load, all in the first call. Revoked and
+// broken files are left out rather than failing the whole listing.
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.dir {
+		return nil, os.ErrInvalid
+	}
+	if f.listed && count > 0 {
+		return nil, io.EOF
+	}
+	f.listed = true
+
+	names, err := f.fs.user.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []os.FileInfo
+	for _, name := range names {
+		info, err := f.fs.Stat(context.Background(), name)
+		if err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+// ContentType goes by the extension alone, as sniffing the content would
+// mean loading the file.
+func (fi fileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(fi.name)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
@@ -0,0 +1,292 @@
+// Package dirsync mirrors a local directory to a user's encrypted namespace.
+//
+// Each pass compares the directory, the namespace and the state recorded at
+// the end of the previous pass. A side that differs from the recorded state
+// has changed; a change on one side is copied to the other, and a file
+// changed on both sides is a conflict. Only regular files directly in the
+// directory are synced, and names starting with a dot are ignored.
+package dirsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// Name of the state database inside the synced directory
+const StateFile = ".dirsync-state"
+
+// Suffix of the local copy kept when a file changed on both sides. Copies
+// from later conflicts, while an earlier one is still there, are numbered
+// after it.
+const ConflictSuffix = ".conflict"
+
+type Action int
+
+const (
+	Uploaded Action = iota
+	Appended
+	Downloaded
+	DeletedLocal
+	DeletedRemote
+	Conflict
+	Failed
+)
+
+func (a Action) String() string {
+	return [...]string{"uploaded", "appended", "downloaded", "deleted locally", "deleted remotely", "conflict", "failed"}[a]
+}
+
+// A Change is something a pass did to a file. Errors that concern a single
+// file are reported as a Failed change rather than stopping the pass.
+type Change struct {
+	Name   string
+	Action Action
+	Err    error
+}
+
+type Syncer struct {
+	user *client.User
+	dir  string
+	key  []byte
+}
+
+func New(user *client.User, dir string) (*Syncer, error) {
+	key, err := user.DeriveKey("dirsync")
+	if err != nil {
+		return nil, err
+	}
+	return &Syncer{user, dir, key}, nil
+}
+
+// Run syncs every interval until ctx is done, reporting each pass's changes
+// to report, which may be nil. Only errors that stop a pass end Run.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration, report func([]Change)) error {
+	for {
+		changes, err := s.Sync()
+		if err != nil {
+			return err
+		}
+		if report != nil && len(changes) > 0 {
+			report(changes)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Sync makes a single pass over the directory and the namespace.
+func (s *Syncer) Sync() (changes []Change, err error) {
+	path := filepath.Join(s.dir, StateFile)
+	st, err := loadState(path, s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := s.localFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := s.user.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, name := range append(append(remote, local...), keys(st)...) {
+		if !strings.HasPrefix(name, ".") && !strings.Contains(name, "/") {
+			names[name] = true
+		}
+	}
+
+	for _, name := range sorted(names) {
+		action, err := s.syncFile(st, name)
+		if err != nil {
+			changes = append(changes, Change{name, Failed, err})
+		} else if action >= 0 {
+			changes = append(changes, Change{name, action, nil})
+		}
+	}
+	return changes, st.store(path, s.key)
+}
+
+// Brings one file up to date, returning what was done or -1 for nothing
+func (s *Syncer) syncFile(st state, name string) (Action, error) {
+	path := filepath.Join(s.dir, name)
+	local, err := os.ReadFile(path)
+	haveLocal := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return -1, err
+	}
+
+	// Every write raises the head's version, so the remote content is only
+	// loaded once the version moved on from the one last synced
+	stat, err := s.user.StatFile(name)
+	haveRemote := err == nil
+	if err != nil && !errors.Is(err, client.ErrFileNotFound) {
+		return -1, err
+	}
+
+	base, synced := st[name]
+	localChanged := haveLocal != synced || (haveLocal && !bytes.Equal(userlib.Hash(local), base.Hash))
+	remoteChanged := haveRemote != synced
+
+	// remote is only loaded, and only needed, if it changed
+	var remote []byte
+	if haveRemote && (!synced || stat.Version != base.Version) {
+		remote, err = s.user.LoadFile(name)
+		if err != nil {
+			return -1, err
+		}
+		remoteChanged = !synced || !bytes.Equal(userlib.Hash(remote), base.Hash)
+	}
+
+	switch {
+	case !localChanged && !remoteChanged,
+		haveLocal == haveRemote && remoteChanged && bytes.Equal(local, remote):
+		st.record(name, local, haveLocal, stat.Version)
+		return -1, nil
+
+	case localChanged && remoteChanged && haveLocal && haveRemote:
+		// Keep the local version beside the remote one; it is uploaded as a
+		// new file on the next pass
+		err = s.keepConflict(path)
+		if err != nil {
+			return -1, err
+		}
+		err = writeFile(path, remote)
+		if err == nil {
+			st.record(name, remote, true, stat.Version)
+		}
+		return Conflict, err
+
+	// From here on, an edit on one side wins over a deletion on the other
+	case remoteChanged && haveRemote:
+		err = writeFile(path, remote)
+		if err == nil {
+			st.record(name, remote, true, stat.Version)
+		}
+		return Downloaded, err
+
+	case remoteChanged && !localChanged:
+		err = os.Remove(path)
+		if err == nil {
+			st.record(name, nil, false, 0)
+		}
+		return DeletedLocal, err
+
+	case !haveLocal:
+		err = s.user.RemoveFile(name)
+		if err == nil {
+			st.record(name, nil, false, 0)
+		}
+		return DeletedRemote, err
+
+	case !remoteChanged && len(local) > base.Size && bytes.Equal(userlib.Hash(local[:base.Size]), base.Hash):
+		err = s.user.AppendToFile(name, local[base.Size:])
+		if err == nil {
+			st.record(name, local, true, s.versionAfter(name, stat.Version))
+		}
+		return Appended, err
+	}
+
+	err = s.user.StoreFile(name, local)
+	if err == nil {
+		st.record(name, local, true, s.versionAfter(name, stat.Version))
+	}
+	return Uploaded, err
+}
+
+// Returns the version to record for name after writing it at version before,
+// 0 for a new file. A write raises the version by one, so if it went up by
+// more, another write came in between and 0 is recorded, which makes the next
+// pass compare the content.
+func (s *Syncer) versionAfter(name string, before int) int {
+	stat, err := s.user.StatFile(name)
+	if err != nil || stat.Version != before+1 {
+		return 0
+	}
+	return stat.Version
+}
+
+// Moves the local file at path aside under the first conflict name not taken
+// yet, so that copies kept from earlier conflicts are not overwritten
+func (s *Syncer) keepConflict(path string) error {
+	for i := 0; ; i += 1 {
+		name := path + ConflictSuffix
+		if i > 0 {
+			name += "." + strconv.Itoa(i)
+		}
+
+		// Linking fails rather than replacing a file already there
+		err := os.Link(path, name)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+}
+
+// Records content as synced at version, or the file as gone from both sides
+func (st state) record(name string, content []byte, present bool, version int) {
+	if present {
+		st[name] = entry{userlib.Hash(content), len(content), version}
+	} else {
+		delete(st, name)
+	}
+}
+
+func (s *Syncer) localFiles() (names []string, err error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func writeFile(path string, content []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err := os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func keys(st state) (names []string) {
+	for name := range st {
+		names = append(names, name)
+	}
+	return names
+}
+
+func sorted(set map[string]bool) (names []string) {
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
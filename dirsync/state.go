@@ -0,0 +1,75 @@
+package dirsync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// ErrStateTampered is returned when the local state database fails
+// authentication, e.g. because it was edited or belongs to another user.
+var ErrStateTampered = errors.New("Sync state failed authentication")
+
+// What a file looked like on both sides after it was last synced. Version is
+// the remote head's version, or 0 if it is not known, in which case the
+// remote content is compared on the next pass.
+type entry struct {
+	Hash    []byte
+	Size    int
+	Version int `json:",omitempty"`
+}
+
+// The state database maps filenames to their last synced entry. It is kept
+// next to the synced files, encrypted and MACed under keys derived from the
+// user, since it reveals filenames and drives deletions.
+type state map[string]entry
+
+func loadState(path string, key []byte) (state, error) {
+	s := make(state)
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(bytes) < userlib.HashSizeBytes+userlib.AESBlockSizeBytes {
+		return nil, ErrStateTampered
+	}
+	mac, enc := bytes[:userlib.HashSizeBytes], bytes[userlib.HashSizeBytes:]
+	m, err := userlib.HMACEval(key[16:32], enc)
+	if err != nil {
+		return nil, err
+	}
+	if !userlib.HMACEqual(m, mac) {
+		return nil, ErrStateTampered
+	}
+
+	err = json.Unmarshal(userlib.SymDec(key[:16], enc), &s)
+	if err != nil {
+		return nil, ErrStateTampered
+	}
+	return s, nil
+}
+
+func (s state) store(path string, key []byte) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	enc := userlib.SymEnc(key[:16], userlib.RandomBytes(16), data)
+	mac, err := userlib.HMACEval(key[16:32], enc)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, append(mac, enc...), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
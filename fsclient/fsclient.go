@@ -0,0 +1,336 @@
+// Package fsclient implements the fsclient command, which stores and shares
+// end-to-end encrypted files from the command line, keeping the datastore and
+// keystore in a local directory. See cmd/fsclient for its usage.
+package fsclient
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/term"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+	"github.com/cs161-staff/project2-starter-code/dirsync"
+	"github.com/cs161-staff/project2-starter-code/localstore"
+)
+
+// Arguments taken by each command, not counting optional ones
+var arity = map[string][2]int{
+	"init":   {0, 0},
+	"login":  {0, 0},
+	"put":    {1, 2},
+	"get":    {1, 2},
+	"append": {1, 2},
+	"share":  {2, 2},
+	"accept": {3, 3},
+	"revoke": {2, -1},
+	"ls":     {0, 0},
+	"rm":     {1, 1},
+	"sync":   {1, 1},
+}
+
+type cli struct {
+	store      string
+	username   string
+	passwordFd int
+	keyfile    string
+	interval   time.Duration
+	once       bool
+	stdin      io.Reader
+	stdout     io.Writer
+	c          *client.Client
+}
+
+// Run runs the command given by args, without the program name. Input is
+// read from stdin, which also carries the password with -password-fd 0, and
+// output is written to stdout.
+func Run(args []string, stdin io.Reader, stdout io.Writer) error {
+	cmd := cli{stdin: stdin, stdout: stdout}
+	flags := flag.NewFlagSet("fsclient", flag.ContinueOnError)
+	flags.StringVar(&cmd.store, "store", defaultStore(), "directory holding the datastore and keystore")
+	flags.StringVar(&cmd.username, "user", os.Getenv("FSCLIENT_USER"), "user to act as instead of the logged in one")
+	flags.IntVar(&cmd.passwordFd, "password-fd", -1, "read the password from this file descriptor")
+	flags.StringVar(&cmd.keyfile, "keyfile", os.Getenv("FSCLIENT_KEYFILE"), "keyfile needed along with the password")
+	flags.DurationVar(&cmd.interval, "interval", 10*time.Second, "how often sync polls")
+	flags.BoolVar(&cmd.once, "once", false, "make a single sync pass")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New("no command given")
+	}
+
+	n, ok := arity[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if len(args)-1 < n[0] || (n[1] >= 0 && len(args)-1 > n[1]) {
+		return fmt.Errorf("wrong number of arguments to %s", args[0])
+	}
+
+	opts, err := localstore.Options(cmd.store)
+	if err != nil {
+		return err
+	}
+	opts.Logger = log.New(io.Discard, "", 0)
+	cmd.c, err = client.NewClient(opts)
+	if err != nil {
+		return err
+	}
+	return cmd.exec(args[0], args[1:])
+}
+
+func defaultStore() string {
+	if dir := os.Getenv("FSCLIENT_STORE"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".fsclient"
+	}
+	return filepath.Join(home, ".fsclient")
+}
+
+func (cmd *cli) exec(name string, args []string) error {
+	if name == "init" || name == "login" {
+		return cmd.login(name == "init")
+	}
+
+	user, err := cmd.user()
+	if err != nil {
+		return err
+	}
+
+	switch name {
+	case "put", "append":
+		content, err := cmd.input(args[1:])
+		if err != nil {
+			return err
+		}
+		if name == "put" {
+			return user.StoreFile(args[0], content)
+		}
+		return user.AppendToFile(args[0], content)
+
+	case "get":
+		content, err := user.LoadFile(args[0])
+		if err != nil {
+			return err
+		}
+		if len(args) == 2 && args[1] != "-" {
+			return os.WriteFile(args[1], content, 0600)
+		}
+		_, err = cmd.stdout.Write(content)
+		return err
+
+	case "share":
+		invitation, err := user.CreateInvitation(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(cmd.stdout, invitation)
+		return err
+
+	case "accept":
+		invitation, err := uuid.Parse(args[1])
+		if err != nil {
+			return fmt.Errorf("bad invitation %q: %v", args[1], err)
+		}
+		return user.AcceptInvitation(args[0], invitation, args[2])
+
+	case "revoke":
+		notShared, err := user.RevokeAccessMany(args[0], args[1:])
+		if err != nil {
+			return err
+		}
+		if len(notShared) > 0 {
+			return fmt.Errorf("%s is not shared with %s", args[0], strings.Join(notShared, ", "))
+		}
+		return nil
+
+	case "ls":
+		names, err := user.ListFiles()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			_, err = fmt.Fprintln(cmd.stdout, name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "rm":
+		return user.RemoveFile(args[0])
+
+	case "sync":
+		return cmd.sync(user, args[0])
+	}
+	return nil
+}
+
+func (cmd *cli) sync(user *client.User, dir string) error {
+	syncer, err := dirsync.New(user, dir)
+	if err != nil {
+		return err
+	}
+
+	report := func(changes []dirsync.Change) {
+		for _, c := range changes {
+			if c.Err != nil {
+				fmt.Fprintf(cmd.stdout, "%s: %s: %v\n", c.Name, c.Action, c.Err)
+			} else {
+				fmt.Fprintf(cmd.stdout, "%s: %s\n", c.Name, c.Action)
+			}
+		}
+	}
+
+	if cmd.once {
+		changes, err := syncer.Sync()
+		report(changes)
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return syncer.Run(ctx, cmd.interval, report)
+}
+
+// Creates or logs in the user, recording them as the current user
+func (cmd *cli) login(create bool) error {
+	if cmd.username == "" {
+		return errors.New("no user given, pass -user")
+	}
+
+	password, err := cmd.password()
+	if err != nil {
+		return err
+	}
+
+	if create && cmd.keyfile != "" {
+		err = cmd.initWithKeyfile(password)
+	} else if create {
+		_, err = cmd.c.InitUser(cmd.username, password)
+	} else {
+		_, err = cmd.getUser(password)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cmd.store, "session"), []byte(cmd.username), 0600)
+}
+
+// Logs in the user given by -user, or else the current user
+func (cmd *cli) user() (*client.User, error) {
+	if cmd.username == "" {
+		name, err := os.ReadFile(filepath.Join(cmd.store, "session"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.New("not logged in, run login or pass -user")
+		} else if err != nil {
+			return nil, err
+		}
+		cmd.username = string(name)
+	}
+
+	password, err := cmd.password()
+	if err != nil {
+		return nil, err
+	}
+	return cmd.getUser(password)
+}
+
+// Logs in with the password and, if -keyfile is given, the keyfile
+func (cmd *cli) getUser(password string) (*client.User, error) {
+	if cmd.keyfile == "" {
+		return cmd.c.GetUser(cmd.username, password)
+	}
+
+	keyfile, err := os.ReadFile(cmd.keyfile)
+	if err != nil {
+		return nil, err
+	}
+	return cmd.c.GetUserWithKeyfile(cmd.username, password, keyfile)
+}
+
+// Creates the user with a keyfile, which must not exist yet
+func (cmd *cli) initWithKeyfile(password string) error {
+	f, err := os.OpenFile(cmd.keyfile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, keyfile, err := cmd.c.InitUserWithKeyfile(cmd.username, password)
+	if err != nil {
+		os.Remove(cmd.keyfile)
+		return err
+	}
+
+	_, err = f.Write(keyfile)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (cmd *cli) password() (string, error) {
+	if cmd.passwordFd == 0 {
+		return readLine(cmd.stdin)
+	} else if cmd.passwordFd > 0 {
+		f := os.NewFile(uintptr(cmd.passwordFd), "password")
+		defer f.Close()
+		return readLine(f)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("no terminal to read the password from, pass -password-fd")
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", cmd.username)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}
+
+// Reads up to the first newline one byte at a time, leaving the rest of r
+// unread in case it also carries the command's input
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 && b[0] != '\n' {
+			line = append(line, b[0])
+			continue
+		}
+		if n == 1 || err == io.EOF {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Reads the content named by args, or stdin if there is none
+func (cmd *cli) input(args []string) ([]byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return io.ReadAll(cmd.stdin)
+	}
+	return os.ReadFile(args[0])
+}
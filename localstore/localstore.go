@@ -0,0 +1,133 @@
+// Package localstore keeps a client's datastore and keystore in a local
+// directory, so that accounts and files persist across runs.
+package localstore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// Datastore stores each entry in a file named after its UUID.
+type Datastore struct {
+	dir string
+}
+
+// Keystore stores each public key as JSON in a file named after the
+// hex-encoded key name.
+type Keystore struct {
+	dir string
+}
+
+// Open returns the stores kept under dir, creating it if needed.
+func Open(dir string) (*Datastore, *Keystore, error) {
+	ds, ks := &Datastore{filepath.Join(dir, "data")}, &Keystore{filepath.Join(dir, "keys")}
+	for _, d := range []string{ds.dir, ks.dir} {
+		err := os.MkdirAll(d, 0700)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ds, ks, nil
+}
+
+// Options returns client options using the stores under dir.
+func Options(dir string) (opts client.Options, err error) {
+	opts.Datastore, opts.Keystore, err = Open(dir)
+	return opts, err
+}
+
+// Get reports entries that cannot be read as missing. Clients use Lookup,
+// which tells the two apart.
+func (d *Datastore) Get(u uuid.UUID) ([]byte, bool) {
+	value, ok, _ := d.Lookup(u)
+	return value, ok
+}
+
+// Lookup fails if the file holding u exists but cannot be read.
+func (d *Datastore) Lookup(u uuid.UUID) ([]byte, bool, error) {
+	value, err := os.ReadFile(filepath.Join(d.dir, u.String()))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (d *Datastore) Set(u uuid.UUID, value []byte) error {
+	return writeFile(filepath.Join(d.dir, u.String()), value, false)
+}
+
+func (d *Datastore) Delete(u uuid.UUID) error {
+	err := os.Remove(filepath.Join(d.dir, u.String()))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (k *Keystore) path(name string) string {
+	return filepath.Join(k.dir, hex.EncodeToString([]byte(name)))
+}
+
+func (k *Keystore) Get(name string) (value userlib.PublicKeyType, ok bool) {
+	bytes, err := os.ReadFile(k.path(name))
+	if err != nil {
+		return value, false
+	}
+
+	err = json.Unmarshal(bytes, &value)
+	if err != nil {
+		return value, false
+	}
+	return value, true
+}
+
+// Set fails if name is already taken.
+func (k *Keystore) Set(name string, value userlib.PublicKeyType) error {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	err = writeFile(k.path(name), bytes, true)
+	if errors.Is(err, os.ErrExist) {
+		return errors.New("Entry in keystore has been taken")
+	}
+	return err
+}
+
+// Writes the file at path in one step, so readers never see a partial write.
+// An exclusive write fails with os.ErrExist if the file is already there.
+func writeFile(path string, value []byte, exclusive bool) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(value)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if exclusive {
+		err = os.Link(f.Name(), path)
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}